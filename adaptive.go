@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Adaptive compression (-L auto): every adaptInterval the controller
+// compares how fast the compressors could go with how fast the senders
+// take blocks. Compression that cannot keep up steps the level down, spare
+// CPU while the link is the bottleneck steps it up. When blocks stop
+// shrinking the level drops to compOff, where only a sample of each block
+// is trial-compressed until the data becomes compressible again.
+const (
+	adaptInterval   = time.Second
+	adaptSlowFactor = 1.2  // compress capacity below demand*1.2: level down
+	adaptFastFactor = 3.0  // above demand*3: level up
+	adaptOffRatio   = 0.97 // compressed/original above this: stop compressing
+	adaptOnRatio    = 0.9  // sample ratio below this: worth compressing
+	adaptSampleSize = 64 * 1024
+)
+
+var compAdaptive bool
+
+var adapt struct {
+	level    int32  // current level, compOff..compBest
+	inBytes  uint64 // since the last tick
+	outBytes uint64
+	nanos    uint64 // time spent compressing, summed over workers
+	consumed uint64 // bytes of blocks taken by the senders
+	skipIn   uint64 // bytes the entropy check sent raw, since the last tick
+	blocks   [compBest + 1]uint64
+	skipped  uint64 // blocks the entropy check sent raw
+	stop     chan struct{}
+}
+
+func adaptLevel() int {
+	return int(atomic.LoadInt32(&adapt.level))
+}
+
+// adaptRecord notes one block compressed (or skipped, at compOff)
+func adaptRecord(level, in, out int, d time.Duration) {
+	atomic.AddUint64(&adapt.inBytes, uint64(in))
+	atomic.AddUint64(&adapt.outBytes, uint64(out))
+	atomic.AddUint64(&adapt.nanos, uint64(d))
+	atomic.AddUint64(&adapt.blocks[level], 1)
+}
+
+// adaptSkipped notes a block the entropy check sends raw: it tells
+// nothing about the compressors' speed or the ratio of the data they get,
+// and the senders' demand on them is lower by it
+func adaptSkipped(n int) {
+	atomic.AddUint64(&adapt.skipIn, uint64(n))
+	atomic.AddUint64(&adapt.skipped, 1)
+}
+
+// adaptConsumed notes a block taken by a sender
+func adaptConsumed(n uint64) {
+	if compAdaptive {
+		atomic.AddUint64(&adapt.consumed, n)
+	}
+}
+
+// sampleCompresses trial-compresses the middle of the block at the
+// fastest level, into scratch
+func sampleCompresses(c Codec, scratch, data []byte) bool {
+	sample := data
+	if len(data) > adaptSampleSize {
+		mid := (len(data) - adaptSampleSize) / 2
+		sample = data[mid : mid+adaptSampleSize]
+	}
+	out, err := c.Encode(scratch[:0], sample, compFast)
+	return err == nil && float64(len(out)) < adaptOnRatio*float64(len(sample))
+}
+
+// startAdaptive runs the controller until stopAdaptive
+func startAdaptive(workers int) {
+	if !compAdaptive {
+		return
+	}
+	adapt.stop = make(chan struct{})
+	Log("adaptive compression: %s, starting at %s\n", codecName(activeCodec), compLevelNames[compDefault])
+
+	go func() {
+		ticker := time.NewTicker(adaptInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				adaptTick(workers)
+			case <-adapt.stop:
+				return
+			}
+		}
+	}()
+}
+
+func adaptTick(workers int) {
+	in := atomic.SwapUint64(&adapt.inBytes, 0)
+	out := atomic.SwapUint64(&adapt.outBytes, 0)
+	nanos := atomic.SwapUint64(&adapt.nanos, 0)
+	consumed := atomic.SwapUint64(&adapt.consumed, 0)
+	skipIn := atomic.SwapUint64(&adapt.skipIn, 0)
+	if in == 0 {
+		return
+	}
+	if consumed > skipIn {
+		consumed -= skipIn
+	} else {
+		consumed = 0
+	}
+
+	ratio := float64(out) / float64(in)
+	demand := float64(consumed) / adaptInterval.Seconds()
+	capacity := demand * adaptFastFactor * 2 // nothing compressed: no limit seen
+	if nanos > 0 {
+		capacity = float64(in) / (float64(nanos) / float64(time.Second)) * float64(workers)
+	}
+
+	cur := adaptLevel()
+	next := cur
+	switch {
+	case cur != compOff && ratio > adaptOffRatio:
+		next = compOff
+	case cur == compOff:
+		if ratio < adaptOnRatio {
+			next = compFast
+		}
+	case capacity < demand*adaptSlowFactor && cur > compFast:
+		next = cur - 1
+	case capacity > demand*adaptFastFactor && cur < compBest:
+		next = cur + 1
+	}
+	if next == cur {
+		return
+	}
+	atomic.StoreInt32(&adapt.level, int32(next))
+	Log("adaptive compression: %s -> %s (ratio %0.2f, compress %0.1f MB/s, senders %0.1f MB/s)\n",
+		compLevelNames[cur], compLevelNames[next], ratio, capacity/mb1, demand/mb1)
+}
+
+// stopAdaptive stops the controller and logs the blocks per level
+func stopAdaptive() {
+	if !compAdaptive || adapt.stop == nil {
+		return
+	}
+	close(adapt.stop)
+	adapt.stop = nil
+
+	var parts []string
+	for level, name := range compLevelNames {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, atomic.LoadUint64(&adapt.blocks[level])))
+	}
+	parts = append(parts, fmt.Sprintf("skipped=%d", atomic.LoadUint64(&adapt.skipped)))
+	Log("adaptive compression: blocks per level: %s\n", strings.Join(parts, " "))
+}
+
+// adaptLevels returns the blocks handled at each level, nil unless -L auto
+func adaptLevels() map[string]uint64 {
+	if !compAdaptive {
+		return nil
+	}
+	levels := make(map[string]uint64)
+	for level, name := range compLevelNames {
+		if n := atomic.LoadUint64(&adapt.blocks[level]); n > 0 {
+			levels[name] = n
+		}
+	}
+	return levels
+}
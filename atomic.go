@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Atomic replace (-atomic): blocks are applied to a temporary sibling of a
+// regular-file destination, renamed over the original only after DONE, the
+// final sync and -verify succeeded. A crash leaves the original untouched.
+var (
+	atomicMode   bool
+	verifyBlocks bool // -verify: re-read the destination before acknowledging DONE
+
+	atomicMu  sync.Mutex
+	atomicTmp string // temporary sibling, "" once committed or removed
+	atomicDst string
+)
+
+// openAtomic creates the temporary sibling of path, cloned from the original
+func openAtomic(path string) (*os.File, error) {
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("-atomic needs a regular file destination, %s is not", path)
+	}
+
+	// A new file gets the umask default, a copy the original's permissions
+	// once its owner is set
+	perm := os.FileMode(0666)
+	if info != nil {
+		perm = 0600
+	}
+	tmp, err := createSibling(path, perm)
+	if err != nil {
+		return nil, err
+	}
+	atomicMu.Lock()
+	atomicTmp, atomicDst = tmp.Name(), path
+	atomicMu.Unlock()
+
+	if info != nil {
+		src, err := os.Open(path)
+		if err != nil {
+			tmp.Close()
+			abortAtomic()
+			return nil, err
+		}
+		defer src.Close()
+		if err := copyAttrs(tmp, src, info); err != nil {
+			Warn("atomic: %s will not keep all attributes of %s: %s\n", tmp.Name(), path, err)
+		}
+		tmp.Chmod(info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+		method, err := cloneFile(tmp, src, info.Size())
+		if err != nil {
+			tmp.Close()
+			abortAtomic()
+			return nil, fmt.Errorf("cloning %s: %w", path, err)
+		}
+		Log("atomic: %s cloned to %s (%s)\n", path, tmp.Name(), method)
+	} else {
+		Log("atomic: writing new file %s\n", tmp.Name())
+	}
+	return tmp, nil
+}
+
+// createSibling creates a hidden file next to path with a random suffix,
+// like os.CreateTemp but with perm (before the umask)
+func createSibling(path string, perm os.FileMode) (*os.File, error) {
+	prefix := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".bsync-")
+	for i := 0; i < 100; i++ {
+		f, err := os.OpenFile(prefix+strconv.FormatUint(uint64(rand.Uint32()), 10), os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("no free temporary name next to %s", path)
+}
+
+// commitAtomic renames the temporary sibling over the destination
+func commitAtomic(file *os.File) error {
+	atomicMu.Lock()
+	defer atomicMu.Unlock()
+	if atomicTmp == "" {
+		return nil
+	}
+
+	// The data must be durable before the rename is, even with -fsync none
+	if fsyncPolicy == "none" {
+		if err := syncData(file); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(atomicTmp, atomicDst); err != nil {
+		return err
+	}
+	atomicTmp = ""
+	if dir, err := os.Open(filepath.Dir(atomicDst)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	Log("atomic: %s replaced\n", atomicDst)
+	return nil
+}
+
+// atomicPending reports whether the temporary sibling is still uncommitted
+func atomicPending() bool {
+	atomicMu.Lock()
+	defer atomicMu.Unlock()
+	return atomicTmp != ""
+}
+
+// abortAtomic removes the temporary sibling unless it was committed
+func abortAtomic() {
+	atomicMu.Lock()
+	defer atomicMu.Unlock()
+	if atomicTmp == "" {
+		return
+	}
+	os.Remove(atomicTmp)
+	Warn("atomic: transfer not finished, %s left unchanged\n", atomicDst)
+	atomicTmp = ""
+}
+
+// copyFile is the portable fallback of cloneFile
+func copyFile(dst, src *os.File) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// verifyDestination re-reads every block that has a known hash and compares
+func verifyDestination(file *os.File, cache *ChecksumCache, fileSize uint64, blockSize uint32) error {
+	if fileSize == 0 {
+		return nil
+	}
+	lastBlockNum := uint32((fileSize - 1) / uint64(blockSize))
+	buf := bufPool.Get(int(blockSize))
+	defer bufPool.Put(buf)
+
+	var checked uint32
+	for idx := uint32(0); idx <= lastBlockNum; idx++ {
+		want, ok := cache.Get(idx)
+		if !ok {
+			continue // skipped with -s, or past the old end and never written
+		}
+		length := blockLen(idx, blockSize, fileSize)
+		n, err := readAt(file, buf[:length], int64(idx)*int64(blockSize))
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("verify block %d: %w", idx, err)
+		}
+
+		got := zeroBlockHash
+		if !isZeroBlock(buf[:n]) {
+			got = checksum(buf[:n])
+		}
+		if bytes.Equal(want, eofBlockHash) {
+			want = zeroBlockHash
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("verify: block %d differs from the source", idx)
+		}
+		checked++
+	}
+	Log("verify: %d blocks match the source\n", checked)
+	return nil
+}
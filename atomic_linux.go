@@ -0,0 +1,77 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile fills dst with src: a reflink where the filesystem supports it,
+// copy_file_range otherwise (in-kernel, keeps holes on most filesystems)
+func cloneFile(dst, src *os.File, size int64) (string, error) {
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil {
+		return "reflink", nil
+	}
+
+	var off int64
+	for off < size {
+		n, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, int(size-off), 0)
+		if err != nil {
+			if off == 0 {
+				return "copy", copyFile(dst, src)
+			}
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+		off += int64(n)
+	}
+	return "copy_file_range", nil
+}
+
+// copyAttrs gives dst the owner and extended attributes of src; what does
+// not carry over (another owner without root, an xattr the filesystem or
+// the user may not set) is returned, the data is not affected
+func copyAttrs(dst, src *os.File, info os.FileInfo) error {
+	var errs []error
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := dst.Chown(int(st.Uid), int(st.Gid)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	sfd, dfd := int(src.Fd()), int(dst.Fd())
+	size, err := unix.Flistxattr(sfd, nil)
+	if err != nil || size == 0 {
+		if err != nil && err != unix.ENOTSUP {
+			errs = append(errs, os.NewSyscallError("flistxattr", err))
+		}
+		return errors.Join(errs...)
+	}
+	list := make([]byte, size)
+	if size, err = unix.Flistxattr(sfd, list); err != nil {
+		return errors.Join(append(errs, os.NewSyscallError("flistxattr", err))...)
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		n, err := unix.Fgetxattr(sfd, name, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("xattr %s: %w", name, err))
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = unix.Fgetxattr(sfd, name, value); err == nil {
+			err = unix.Fsetxattr(dfd, name, value[:n], 0)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("xattr %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
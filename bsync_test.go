@@ -2,7 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -135,6 +143,9 @@ func TestParseSSHTarget(t *testing.T) {
 		{"SSH with port localhost", "user@localhost:8022:/tmp/file", "user", "localhost", "8022", "/tmp/file"},
 		{"local file no colon", "localfile", "", "", "", "localfile"},
 		{"IPv4 with port", "user@192.168.1.1:1022:/data", "user", "192.168.1.1", "1022", "/data"},
+		{"IPv6 in brackets", "user@[2001:db8::1]:/dev/vdb", "user", "2001:db8::1", "", "/dev/vdb"},
+		{"IPv6 with port", "[::1]:2222:/data", "", "::1", "2222", "/data"},
+		{"IPv6 windows path", "admin@[fe80::1%eth0]:C:/img", "admin", "fe80::1%eth0", "", "C:/img"},
 	}
 
 	for _, tt := range tests {
@@ -256,8 +267,11 @@ func TestPackUnpack(t *testing.T) {
 				FileSize:   1024000,
 				DataSize:   256,
 				Compressed: true,
+				Codec:      codecLZ4,
 				Zero:       true,
 				Done:       true,
+				DryRun:     true,
+				Hash:       [16]byte{1, 2, 3, 15: 0xff},
 			},
 		},
 	}
@@ -271,8 +285,8 @@ func TestPackUnpack(t *testing.T) {
 			}
 
 			// Verify packed size
-			// MagicHead: 17 bytes + BlockIdx: 4 + BlockSize: 4 + FileSize: 8 + DataSize: 4 + flags: 3 = 40 bytes
-			expectedSize := 17 + 4 + 4 + 8 + 4 + 1 + 1 + 1 // 40 bytes
+			// MagicHead: 17 bytes + BlockIdx: 4 + BlockSize: 4 + FileSize: 8 + DataSize: 4 + flags: 5 + Codec: 1 + Hash: 16 = 59 bytes
+			expectedSize := 17 + 4 + 4 + 8 + 4 + 1 + 1 + 1 + 1 + 1 + 1 + 16 // 59 bytes
 			if len(data) != expectedSize {
 				t.Errorf("pack() size = %d, want %d", len(data), expectedSize)
 			}
@@ -290,8 +304,11 @@ func TestPackUnpack(t *testing.T) {
 				unpacked.FileSize != tt.msg.FileSize ||
 				unpacked.DataSize != tt.msg.DataSize ||
 				unpacked.Compressed != tt.msg.Compressed ||
+				unpacked.Codec != tt.msg.Codec ||
 				unpacked.Zero != tt.msg.Zero ||
-				unpacked.Done != tt.msg.Done {
+				unpacked.Done != tt.msg.Done ||
+				unpacked.DryRun != tt.msg.DryRun ||
+				unpacked.Hash != tt.msg.Hash {
 				t.Errorf("round-trip mismatch: got %+v, want %+v", unpacked, tt.msg)
 			}
 		})
@@ -304,7 +321,7 @@ func TestStringToFixedSizeArray(t *testing.T) {
 		name  string
 		input string
 	}{
-		{"exact length", "blockSync-ver0.01"},
+		{"exact length", "blockSync-ver0.06"},
 		{"short string", "short"},
 		{"empty string", ""},
 		{"long string", "this is a very long string that exceeds the array size"},
@@ -365,32 +382,73 @@ func TestGetDeviceSize(t *testing.T) {
 	}
 }
 
-// Test compress and decompress round-trip
+// Test compress and decompress round-trip with every codec and level
 func TestCompressDecompress(t *testing.T) {
-	testData := []byte("This is test data that should compress reasonably well because it has repeating patterns")
+	defer func() { activeCodec = codecZstd; SetCompressionLevel("default") }()
+	testData := bytes.Repeat([]byte("This is test data that should compress reasonably well because it has repeating patterns"), 100)
+	random := make([]byte, 64*1024)
+	rand.Read(random)
 
-	// Compress
-	compressed, err := compressData(testData)
-	if err != nil {
-		t.Fatalf("compressData() error: %v", err)
-	}
+	for id, c := range codecs {
+		for _, level := range []string{"fast", "default", "better", "best"} {
+			activeCodec = id
+			SetCompressionLevel(level)
 
-	// Decompress
-	decompressed, err := decompressData(compressed)
-	if err != nil {
-		t.Fatalf("decompressData() error: %v", err)
+			// Compress
+			compressed, codec, err := compressData(make([]byte, len(testData)), testData)
+			if err != nil {
+				t.Fatalf("%s/%s: compressData() error: %v", c.Name(), level, err)
+			}
+			if codec != id || len(compressed) >= len(testData) {
+				t.Errorf("%s/%s: codec %d, %d -> %d bytes", c.Name(), level, codec, len(testData), len(compressed))
+			}
+
+			// Decompress
+			decompressed, err := decompressData(nil, compressed, codec, len(testData))
+			if err != nil {
+				t.Fatalf("%s/%s: decompressData() error: %v", c.Name(), level, err)
+			}
+
+			// Compare
+			if !bytes.Equal(decompressed, testData) {
+				t.Errorf("%s/%s: compress/decompress round-trip failed: data mismatch", c.Name(), level)
+			}
+
+			// A block of another size than expected is rejected
+			for _, size := range []int{len(testData) - 1, len(testData) + 1} {
+				if _, err := decompressData(nil, compressed, codec, size); err == nil {
+					t.Errorf("%s/%s: decoded %d bytes as a block of %d", c.Name(), level, len(testData), size)
+				}
+			}
+
+			// Random data does not fit in a buffer of its own size
+			if out, _, err := compressData(make([]byte, len(random)), random); err == nil && len(out) < len(random) {
+				t.Errorf("%s/%s: random data compressed to %d bytes", c.Name(), level, len(out))
+			}
+
+			// A buffer of compressBound bytes holds the output, whatever the data
+			for _, data := range [][]byte{testData, random} {
+				buf := make([]byte, compressBound(len(data)))
+				if out, _, err := compressData(buf, data); err == nil && &out[0] != &buf[0] {
+					t.Errorf("%s/%s: %d bytes compressed outside the buffer", c.Name(), level, len(data))
+				}
+			}
+		}
 	}
 
-	// Compare
-	if !bytes.Equal(decompressed, testData) {
-		t.Error("compress/decompress round-trip failed: data mismatch")
+	activeCodec = codecNone
+	if _, _, err := compressData(make([]byte, len(testData)), testData); err != errIncompressible {
+		t.Errorf("codec none: compressData() error = %v, want errIncompressible", err)
+	}
+	if _, err := decompressData(nil, testData, 200, len(testData)); err == nil {
+		t.Error("decompressData() with an unknown codec = nil error")
 	}
 }
 
 // Test compressData with zeros
 func TestCompressZeros(t *testing.T) {
 	zeros := make([]byte, 1024)
-	compressed, err := compressData(zeros)
+	compressed, _, err := compressData(make([]byte, len(zeros)), zeros)
 	if err != nil {
 		t.Fatalf("compressData() error: %v", err)
 	}
@@ -400,3 +458,1134 @@ func TestCompressZeros(t *testing.T) {
 		t.Logf("Warning: zeros didn't compress: %d -> %d", len(zeros), len(compressed))
 	}
 }
+
+// Test parseRate
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    uint64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"1000", 1000, false},
+		{"512K", 512 * 1024, false},
+		{"50M", 50 * 1024 * 1024, false},
+		{"1.5G", 3 * 512 * 1024 * 1024, false},
+		{"abc", 0, true},
+		{"-5M", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseRate(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRate(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseRate(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+// Test schedule parsing and time-of-day selection
+func TestScheduledRate(t *testing.T) {
+	entries, err := parseSchedule("08:00-18:00=10M, 22:00-06:00=0")
+	if err != nil {
+		t.Fatalf("parseSchedule() error: %v", err)
+	}
+
+	tests := []struct {
+		clock string
+		want  uint64
+	}{
+		{"07:59", 1234},
+		{"08:00", 10 * 1024 * 1024},
+		{"17:59", 10 * 1024 * 1024},
+		{"18:00", 1234},
+		{"23:30", 0},
+		{"03:00", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clock, func(t *testing.T) {
+			now, _ := time.Parse("15:04", tt.clock)
+			if got := scheduledRate(entries, 1234, now); got != tt.want {
+				t.Errorf("scheduledRate(%s) = %d, want %d", tt.clock, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseSchedule("08:00=10M"); err == nil {
+		t.Error("parseSchedule() accepted entry without window")
+	}
+}
+
+// Test blockLen
+func TestBlockLen(t *testing.T) {
+	tests := []struct {
+		name     string
+		idx      uint32
+		fileSize uint64
+		want     uint64
+	}{
+		{"full block", 0, 2500, 1000},
+		{"middle block", 1, 2500, 1000},
+		{"tail block", 2, 2500, 500},
+		{"exact multiple", 1, 2000, 1000},
+		{"beyond end", 3, 2500, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := blockLen(tt.idx, 1000, tt.fileSize); got != tt.want {
+				t.Errorf("blockLen(%d) = %d, want %d", tt.idx, got, tt.want)
+			}
+		})
+	}
+}
+
+// Test parseLogLevel
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   logLevel
+		wantOk bool
+	}{
+		{"error", levelError, true},
+		{"WARN", levelWarn, true},
+		{"info", levelInfo, true},
+		{"Debug", levelDebug, true},
+		{"trace", levelTrace, true},
+		{"verbose", levelInfo, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, ok := parseLogLevel(tt.input)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseLogLevel(%q) = %v, %v, want %v, %v", tt.input, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+// Test blockRanges
+func TestBlockRanges(t *testing.T) {
+	got := blockRanges([]uint32{7, 1, 2, 3, 10, 11, 5})
+	want := [][2]uint32{{1, 3}, {5, 5}, {7, 7}, {10, 11}}
+	if len(got) != len(want) {
+		t.Fatalf("blockRanges() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("blockRanges()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if got := blockRanges(nil); len(got) != 0 {
+		t.Errorf("blockRanges(nil) = %v, want empty", got)
+	}
+}
+
+// Test dataMap hole lookup
+func TestDataMapIsHole(t *testing.T) {
+	m := &dataMap{extents: [][2]int64{{100, 200}, {400, 450}}, size: 1000}
+
+	tests := []struct {
+		name   string
+		off    int64
+		length int64
+		want   bool
+	}{
+		{"before first extent", 0, 100, true},
+		{"overlaps first extent", 50, 100, false},
+		{"inside extent", 120, 10, false},
+		{"between extents", 200, 200, true},
+		{"touches second extent", 300, 101, false},
+		{"after last extent", 450, 100, true},
+		{"tail clamped to size", 900, 500, true},
+		{"beyond EOF", 1000, 100, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.isHole(tt.off, tt.length); got != tt.want {
+				t.Errorf("isHole(%d, %d) = %v, want %v", tt.off, tt.length, got, tt.want)
+			}
+		})
+	}
+
+	var unknown *dataMap
+	if unknown.isHole(0, 100) {
+		t.Error("nil dataMap must never report holes")
+	}
+}
+
+// Test applySizePolicy on regular files
+func TestApplySizePolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		dstSize   int64
+		srcSize   uint64
+		checkOnly bool
+		wantErr   bool
+		wantSize  int64
+	}{
+		{"match grows", "match", 100, 300, false, false, 300},
+		{"match shrinks", "match", 300, 100, false, false, 100},
+		{"match check only", "match", 300, 100, true, false, 300},
+		{"keep grows", "keep", 100, 300, false, false, 300},
+		{"keep never shrinks", "keep", 300, 100, false, false, 300},
+		{"fail smaller", "fail", 100, 300, false, true, 100},
+		{"fail larger", "fail", 300, 100, false, false, 300},
+		{"equal", "fail", 200, 200, false, false, 200},
+	}
+
+	defer func() { sizePolicy = "match" }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := os.Create(t.TempDir() + "/dst.img")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			file.Truncate(tt.dstSize)
+
+			sizePolicy = tt.policy
+			err = applySizePolicy(file, tt.srcSize, tt.checkOnly)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("applySizePolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			info, _ := file.Stat()
+			if info.Size() != tt.wantSize {
+				t.Errorf("file size = %d, want %d", info.Size(), tt.wantSize)
+			}
+		})
+	}
+}
+
+// Test parseMountinfo
+func TestParseMountinfo(t *testing.T) {
+	input := `28 1 254:0 / / rw,relatime - ext4 /dev/vda rw,discard
+29 28 0:45 / /mnt/my\040data rw - btrfs /dev/mapper/vg-data rw
+31 28 254:0 /srv /srv rw - ext4 /dev/vda rw
+30 28 0:22 / /proc rw,relatime - proc proc rw
+bogus line
+`
+	mounts, sources := parseMountinfo(strings.NewReader(input))
+
+	tests := []struct {
+		devnum string
+		want   string
+	}{
+		{"254:0", "/,/srv"},
+		{"0:45", "/mnt/my data"},
+		{"0:22", "/proc"},
+		{"8:0", ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(mounts[tt.devnum], ","); got != tt.want {
+			t.Errorf("mounts[%s] = %q, want %q", tt.devnum, got, tt.want)
+		}
+	}
+
+	if len(sources) != 2 || sources["/dev/mapper/vg-data"][0] != "/mnt/my data" || sources["/dev/vda"][0] != "/" {
+		t.Errorf("sources = %v", sources)
+	}
+}
+
+// Test unescapeMount and unescapeUdev
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(string) string
+		in   string
+		want string
+	}{
+		{"mount plain", unescapeMount, "/mnt/data", "/mnt/data"},
+		{"mount space", unescapeMount, `/mnt/my\040data`, "/mnt/my data"},
+		{"mount trailing backslash", unescapeMount, `/mnt/x\`, `/mnt/x\`},
+		{"udev plain", unescapeUdev, "BACKUP", "BACKUP"},
+		{"udev space", unescapeUdev, `my\x20disk`, "my disk"},
+		{"udev bad escape", unescapeUdev, `a\xZZ`, `a\xZZ`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fn(tt.in); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test alignedBuf and the direct I/O alignment checks
+func TestAlignedBuf(t *testing.T) {
+	for _, size := range []int{1, 4096, 10000, 1 << 20} {
+		buf := alignedBuf(size)
+		if len(buf) != size || cap(buf) != size {
+			t.Errorf("alignedBuf(%d): len %d cap %d", size, len(buf), cap(buf))
+		}
+		if !isAlignedMem(buf) {
+			t.Errorf("alignedBuf(%d) not aligned", size)
+		}
+	}
+
+	buf := alignedBuf(3 * directAlign)
+	tests := []struct {
+		name string
+		buf  []byte
+		off  int64
+		want bool
+	}{
+		{"full block", buf, 0, true},
+		{"aligned offset", buf[:directAlign], 2 * directAlign, true},
+		{"unaligned offset", buf, 512, false},
+		{"tail length", buf[:directAlign+100], 0, false},
+		{"empty", buf[:0], 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAlignedIO(tt.buf, tt.off); got != tt.want {
+				t.Errorf("isAlignedIO() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test setFsyncPolicy
+func TestSetFsyncPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		every  uint64
+	}{
+		{"none", 0},
+		{"end", 0},
+		{"block", 1},
+		{"64", 64},
+	}
+	defer func() { fsyncPolicy, fsyncEvery = "end", 0 }()
+	for _, tt := range tests {
+		fsyncEvery = 0
+		setFsyncPolicy(tt.policy)
+		if fsyncPolicy != tt.policy || fsyncEvery != tt.every {
+			t.Errorf("setFsyncPolicy(%q): policy %q every %d, want every %d", tt.policy, fsyncPolicy, fsyncEvery, tt.every)
+		}
+	}
+}
+
+// Test verifyDestination against the checksum cache
+func TestVerifyDestination(t *testing.T) {
+	const bs = 4096
+	data := make([]byte, 2*bs+100) // block 1 stays zero, block 2 is a short tail
+	for i := range data[:bs] {
+		data[i] = byte(i)
+	}
+	copy(data[2*bs:], "tail")
+
+	file, err := os.Create(t.TempDir() + "/dst.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Write(data)
+
+	cache := NewChecksumCache(2)
+	cache.Set(0, checksum(data[:bs]))
+	cache.Set(1, eofBlockHash) // zero block past the old end
+	cache.Set(2, checksum(data[2*bs:]))
+	if err := verifyDestination(file, cache, uint64(len(data)), bs); err != nil {
+		t.Errorf("verifyDestination() = %v, want nil", err)
+	}
+
+	file.WriteAt([]byte{0xff}, 2*bs+1)
+	if err := verifyDestination(file, cache, uint64(len(data)), bs); err == nil {
+		t.Error("verifyDestination() = nil for a corrupted block")
+	}
+
+	cache.Delete(2) // unknown hashes are skipped
+	if err := verifyDestination(file, cache, uint64(len(data)), bs); err != nil {
+		t.Errorf("verifyDestination() = %v with block 2 unknown", err)
+	}
+}
+
+func TestChecksumCacheFind(t *testing.T) {
+	cache := NewChecksumCache(3)
+	a, b := checksum([]byte("a")), checksum([]byte("b"))
+	cache.Set(0, a)
+	cache.Set(1, zeroBlockHash)
+	cache.Set(2, eofBlockHash)
+	cache.Set(3, unreadableHash)
+
+	if idx, ok := cache.Find(a); !ok || idx != 0 {
+		t.Errorf("Find(a) = %d, %v, want 0, true", idx, ok)
+	}
+	for _, h := range [][]byte{zeroBlockHash, eofBlockHash, unreadableHash} {
+		if _, ok := cache.Find(h); ok {
+			t.Errorf("Find(%q) found a block, markers must not be indexed", h)
+		}
+	}
+
+	cache.Set(0, b) // block 0 rewritten: a is gone
+	if _, ok := cache.Find(a); ok {
+		t.Error("Find(a) still finds block 0 after it was rewritten")
+	}
+	cache.Delete(0)
+	if _, ok := cache.Find(b); ok {
+		t.Error("Find(b) finds a deleted block")
+	}
+}
+
+func TestChecksumCacheWindow(t *testing.T) {
+	cache := NewChecksumCache(10 * cachePageSlots)
+	cache.window = 2 * cachePageSlots
+	hash := checksum([]byte("a"))
+
+	// Set wakes the waiter of its own slot only
+	got := make(chan []byte, 1)
+	go func() { got <- cache.WaitFor(7) }()
+	time.Sleep(10 * time.Millisecond)
+	cache.Set(6, zeroBlockHash)
+	select {
+	case <-got:
+		t.Fatal("WaitFor(7) returned after Set(6)")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cache.Set(7, hash)
+	if h := <-got; !bytes.Equal(h, hash) {
+		t.Errorf("WaitFor(7) = %x, want %x", h, hash)
+	}
+
+	// The hashers stay within the window ahead of the transfer
+	room := make(chan struct{})
+	go func() {
+		cache.WaitRoom(3*cachePageSlots + 7)
+		close(room)
+	}()
+	select {
+	case <-room:
+		t.Fatal("WaitRoom returned beyond the window")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cache.Advance(cachePageSlots + 8)
+	select {
+	case <-room:
+	case <-time.After(time.Second):
+		t.Fatal("WaitRoom did not return after Advance")
+	}
+
+	// Pages behind the window are evicted, with their dedup entries
+	cache.Advance(3*cachePageSlots + 8)
+	if h := cache.WaitFor(7); h != nil {
+		t.Errorf("WaitFor(7) = %x after eviction, want nil", h)
+	}
+	if _, ok := cache.Find(hash); ok {
+		t.Error("Find() finds an evicted block")
+	}
+	cache.Set(7, hash) // late Set of an evicted block is dropped
+	if _, ok := cache.Get(7); ok {
+		t.Error("Get(7) finds a block set after eviction")
+	}
+	cache.Set(2*cachePageSlots, hash)
+	if h := cache.WaitFor(2 * cachePageSlots); !bytes.Equal(h, hash) {
+		t.Errorf("WaitFor() in the window = %x, want %x", h, hash)
+	}
+}
+
+func TestReuseBlock(t *testing.T) {
+	const bs = 4096
+	data := make([]byte, 2*bs+100) // block 1 is zero, block 2 a short tail
+	for i := range data[:bs] {
+		data[i] = byte(i)
+	}
+
+	file, err := os.Create(t.TempDir() + "/dst.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Write(data)
+
+	cache := NewChecksumCache(2)
+	for idx := uint32(0); idx <= 2; idx++ {
+		end := int(idx+1) * bs
+		if end > len(data) {
+			end = len(data)
+		}
+		cache.Set(idx, checksum(data[int(idx)*bs:end]))
+	}
+
+	msg := &Msg{BlockIdx: 1, BlockSize: bs, FileSize: uint64(len(data))}
+	copy(msg.Hash[:], checksum(data[:bs]))
+	buf := alignedBuf(bs)
+	if !reuseBlock(file, cache, msg, buf) {
+		t.Fatal("reuseBlock() = false, want block 1 copied from block 0")
+	}
+	got := make([]byte, bs)
+	file.ReadAt(got, bs)
+	if !bytes.Equal(got, data[:bs]) {
+		t.Error("block 1 does not hold block 0's data")
+	}
+	if h, _ := cache.Get(1); !bytes.Equal(h, msg.Hash[:]) {
+		t.Error("cache not updated for the copied block")
+	}
+
+	// Cache says block 0 holds the tail's content, but it does not
+	tail := []byte("new tail content")
+	cache.Set(0, checksum(tail))
+	msg = &Msg{BlockIdx: 2, BlockSize: bs, FileSize: 2*bs + uint64(len(tail))}
+	copy(msg.Hash[:], checksum(tail))
+	if reuseBlock(file, cache, msg, buf) {
+		t.Error("reuseBlock() = true for a copy that does not match")
+	}
+	if h, _ := cache.Get(2); bytes.Equal(h, msg.Hash[:]) {
+		t.Error("cache claims block 2 matches after a failed copy")
+	}
+}
+
+func TestParseRescueMap(t *testing.T) {
+	input := "# bsync rescue map\n\n0x00A00000  0x00000200\n4096 512 -\n"
+	ranges, err := parseRescueMap(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseRescueMap() error: %v", err)
+	}
+	want := []badRange{{Off: 4096, Len: 512}, {Off: 0xA00000, Len: 0x200}}
+	if len(ranges) != len(want) || ranges[0] != want[0] || ranges[1] != want[1] {
+		t.Errorf("parseRescueMap() = %+v, want %+v", ranges, want)
+	}
+
+	for _, bad := range []string{"4096\n", "x 512\n", "4096 0\n", "-1 512\n"} {
+		if _, err := parseRescueMap(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseRescueMap(%q) = nil error", bad)
+		}
+	}
+
+	path := t.TempDir() + "/bad.map"
+	if err := writeRescueMap(path, want); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := os.Open(path)
+	defer f.Close()
+	back, err := parseRescueMap(f)
+	if err != nil || len(back) != len(want) || back[0] != want[0] || back[1] != want[1] {
+		t.Errorf("map round trip = %+v, %v, want %+v", back, err, want)
+	}
+}
+
+func TestRescueMapRanges(t *testing.T) {
+	defer func() { rescueRetry = false }()
+	rescueRetry = true
+
+	// A retry pass interrupted after the first block keeps what is still
+	// unreadable there and the ranges it has not read again
+	rs := &rescueState{retry: []badRange{{100, 10}, {4000, 200}, {9000, 50}}}
+	if !rs.wanted(0, 4096) {
+		t.Fatalf("first block not wanted")
+	}
+	rs.bad = []badRange{{4050, 20}}
+	want := []badRange{{4050, 20}, {4096, 104}, {9000, 50}}
+	got := rs.mapRanges()
+	if len(got) != len(want) {
+		t.Fatalf("mapRanges() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("mapRanges() = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestFillPattern(t *testing.T) {
+	defer func() { rescuePattern = nil }()
+
+	tests := []struct {
+		fill string
+		off  int64
+		want string
+	}{
+		{"zero", 0, "\x00\x00\x00\x00\x00"},
+		{"0xdead", 1, "\xad\xde\xad\xde\xad"},
+		{"BAD!", 6, "D!BAD"}, // pattern follows the file offset
+	}
+	for _, tt := range tests {
+		pattern, err := parseFillPattern(tt.fill)
+		if err != nil {
+			t.Fatalf("parseFillPattern(%q) error: %v", tt.fill, err)
+		}
+		rescuePattern = pattern
+		buf := []byte("xxxxx")
+		fillPattern(buf, tt.off)
+		if string(buf) != tt.want {
+			t.Errorf("fill %q at %d = %q, want %q", tt.fill, tt.off, buf, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"0x", "0xzz", "0xabc"} {
+		if _, err := parseFillPattern(bad); err == nil {
+			t.Errorf("parseFillPattern(%q) = nil error", bad)
+		}
+	}
+}
+
+func TestAdaptTick(t *testing.T) {
+	defer SetCompressionLevel("default")
+	SetCompressionLevel("auto")
+
+	const mb = 1 << 20
+	sec := uint64(time.Second)
+	tests := []struct {
+		name      string
+		level     int
+		in, out   uint64
+		nanos     uint64 // compress time in the interval
+		consumed  uint64 // bytes taken by the senders
+		wantLevel int
+	}{
+		{"incompressible", compDefault, 100 * mb, 99 * mb, sec / 4, 50 * mb, compOff},
+		{"compressible again", compOff, 100 * mb, 60 * mb, sec / 10, 50 * mb, compFast},
+		{"still incompressible", compOff, 100 * mb, 100 * mb, 0, 50 * mb, compOff},
+		{"cpu bound", compBetter, 100 * mb, 50 * mb, sec, 100 * mb, compDefault},
+		{"cpu bound at fast", compFast, 100 * mb, 50 * mb, sec, 100 * mb, compFast},
+		{"link bound", compDefault, 100 * mb, 50 * mb, sec / 10, 10 * mb, compBetter},
+		{"link bound at best", compBest, 100 * mb, 50 * mb, sec / 10, 10 * mb, compBest},
+		{"balanced", compDefault, 100 * mb, 50 * mb, sec / 2, 100 * mb, compDefault},
+		{"idle", compDefault, 0, 0, 0, 0, compDefault},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&adapt.level, int32(tt.level))
+		atomic.StoreUint64(&adapt.inBytes, tt.in)
+		atomic.StoreUint64(&adapt.outBytes, tt.out)
+		atomic.StoreUint64(&adapt.nanos, tt.nanos)
+		atomic.StoreUint64(&adapt.consumed, tt.consumed)
+		adaptTick(1)
+		if got := adaptLevel(); got != tt.wantLevel {
+			t.Errorf("%s: level %s, want %s", tt.name, compLevelNames[got], compLevelNames[tt.wantLevel])
+		}
+	}
+}
+
+func TestAdaptTickSkipped(t *testing.T) {
+	defer SetCompressionLevel("default")
+	SetCompressionLevel("auto")
+
+	const mb = 1 << 20
+	sec := time.Second
+	tests := []struct {
+		name       string
+		compressed [][2]int // in, out of compressed blocks
+		nanos      time.Duration
+		skipped    []int // blocks sent raw by the entropy check
+		consumed   uint64
+		wantLevel  int
+	}{
+		// Mostly incompressible regions do not switch compression off for the
+		// rest, and the link keeps up with the few blocks compressed
+		{"few compressible", [][2]int{{2 * mb, mb}, {2 * mb, mb}}, sec / 10, []int{32 * mb, 32 * mb, 32 * mb}, 100 * mb, compBetter},
+		// Skipped blocks add no speed: compressing is still too slow
+		{"cpu bound", [][2]int{{30 * mb, 15 * mb}, {30 * mb, 15 * mb}}, sec, []int{40 * mb}, 100 * mb, compFast},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&adapt.level, compDefault)
+		atomic.StoreUint64(&adapt.consumed, tt.consumed)
+		for _, c := range tt.compressed {
+			adaptRecord(compDefault, c[0], c[1], tt.nanos/time.Duration(len(tt.compressed)))
+		}
+		for _, n := range tt.skipped {
+			adaptSkipped(n)
+		}
+		adaptTick(1)
+		if got := adaptLevel(); got != tt.wantLevel {
+			t.Errorf("%s: level %s, want %s", tt.name, compLevelNames[got], compLevelNames[tt.wantLevel])
+		}
+	}
+}
+
+func TestSampleEntropy(t *testing.T) {
+	random := make([]byte, 1<<20)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("2026-01-01 10:00:00 [client] block 17 in sync\n"), 1<<14)
+
+	tests := []struct {
+		name string
+		data []byte
+		min  float64
+		max  float64
+	}{
+		{"empty", nil, 0, 0},
+		{"zeros", make([]byte, 1<<20), 0, 0},
+		{"two bytes", bytes.Repeat([]byte{0, 1}, 1<<10), 1, 1},
+		{"text", text, 3, 5},
+		{"random", random, 7.9, 8},
+		{"short random", random[:1000], 7, 8},
+	}
+	for _, tt := range tests {
+		if got := sampleEntropy(tt.data); got < tt.min || got > tt.max {
+			t.Errorf("%s: entropy %0.3f, want %0.1f-%0.1f", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestWorthCompressingRegion(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("block 17 in sync\n"), 4096)
+
+	region.streak, region.skipFrom, region.skipUntil, region.backoff = 0, 0, 0, 0
+	defer func() { region.streak, region.skipFrom, region.skipUntil, region.backoff = 0, 0, 0, 0 }()
+
+	// blocks 0-3 are checked, the fourth opens a window over 4-11 in which
+	// only block 11 is checked; compressible data there ends the window
+	for idx := uint32(0); idx < 11; idx++ {
+		if worthCompressing(idx, random) {
+			t.Fatalf("block %d: random data would be compressed", idx)
+		}
+	}
+	entropy := atomic.LoadUint64(&compStats.skippedEntropy)
+	if !worthCompressing(11, text) {
+		t.Fatalf("block 11: probe in the window did not check the data")
+	}
+	if atomic.LoadUint64(&compStats.skippedEntropy) != entropy {
+		t.Errorf("probe counted as skipped")
+	}
+	if !worthCompressing(12, text) {
+		t.Errorf("block 12: window not closed by compressible data")
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	defer setDictionary(nil)
+
+	// Records sharing their structure across blocks, little repetition inside one
+	words := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+	var src bytes.Buffer
+	for i := 0; src.Len() < 4<<20; i++ {
+		fmt.Fprintf(&src, "{\"id\":%d,\"name\":\"%s-%s\",\"status\":\"active\",\"tags\":[\"%s\"],\"created\":\"2026-01-%02dT10:00:00Z\"}\n",
+			i*7919%100003, words[i%8], words[i*3%8], words[i*5%8], i%28+1)
+	}
+	const bs = 16 * 1024
+	file, err := os.Create(t.TempDir() + "/src.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Write(src.Bytes())
+
+	block := src.Bytes()[bs : 2*bs]
+	plain, _, err := compressData(make([]byte, len(block)), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := trainDictionary(file, bs, uint64(src.Len()))
+	if err != nil {
+		t.Fatalf("training: %v", err)
+	}
+	if err := setDictionary(d); err != nil {
+		t.Fatal(err)
+	}
+	withDict, codec, err := compressData(make([]byte, len(block)), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withDict) >= len(plain) {
+		t.Errorf("dictionary did not help: %d bytes, %d without", len(withDict), len(plain))
+	}
+	for name, data := range map[string][]byte{"with dictionary": withDict, "without": plain} {
+		out, err := decompressData(nil, data, codec, len(block))
+		if err != nil || !bytes.Equal(out, block) {
+			t.Errorf("%s: round trip failed: %v", name, err)
+		}
+	}
+
+	setDictionary(nil)
+	if _, err := decompressData(nil, withDict, codec, len(block)); err == nil {
+		t.Errorf("decoded a dictionary block without the dictionary")
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	const bs = 4096
+
+	// Released buffers are reused
+	p := newBufferPool(0, 0)
+	a := p.Get(bs)
+	p.Put(a)
+	if b := p.Get(bs - 512); &b[0] != &a[0] || len(b) != bs-512 {
+		t.Errorf("free buffer not reused")
+	}
+
+	// Budget of 4 blocks, 1 reserved for in-flight stages
+	p = newBufferPool(4*bs, bs)
+	held := [][]byte{p.Get(bs), p.Get(bs), p.Get(bs)}
+	got := make(chan []byte)
+	go func() { got <- p.Get(bs) }()
+	select {
+	case <-got:
+		t.Fatalf("Get past the budget did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The reserve is still there for GetInFlight, and reuse counts too
+	inFlight := p.GetInFlight(bs)
+	p.Put(inFlight)
+	select {
+	case <-got:
+		t.Fatalf("Get took the reserve")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Put(held[0])
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatalf("Put did not wake a waiting Get")
+	}
+	if allocated, peak, waits := p.stats(); allocated > 4*bs || peak > 4*bs || waits != 1 {
+		t.Errorf("allocated %d, peak %d, waits %d", allocated, peak, waits)
+	}
+
+	// A block larger than the budget is served once nothing is in use
+	p = newBufferPool(4*bs, bs)
+	if b := p.Get(8 * bs); len(b) != 8*bs {
+		t.Errorf("oversized Get returned %d bytes", len(b))
+	}
+}
+
+func TestPipeEndpoint(t *testing.T) {
+	if ep, err := resolveEndpoint("127.0.0.1:8080"); err != nil || ep.pipe {
+		t.Fatalf("resolveEndpoint(tcp) = %+v, %v, want a TCP endpoint", ep, err)
+	}
+	ep, err := resolveEndpoint(pipeAddr)
+	if err != nil || !ep.pipe {
+		t.Fatalf("resolveEndpoint(%q) = %+v, %v, want the pipe", pipeAddr, ep, err)
+	}
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	defer inW.Close()
+	defer outR.Close()
+	saved := stdioPipe
+	stdioPipe = &pipeConn{in: inR, out: outW}
+	defer func() { stdioPipe = saved }()
+
+	// Connections take the stream in turn, closing one leaves it open
+	for _, word := range []string{"dict", "DONE"} {
+		conn := NewAutoReconnectTCP(ep)
+		go func() {
+			buf := make([]byte, len(word))
+			io.ReadFull(outR, buf)
+			inW.Write(buf)
+		}()
+		if err := connWrite(conn, []byte(word)); err != nil {
+			t.Fatalf("write %s: %v", word, err)
+		}
+		got := make([]byte, len(word))
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != word {
+			t.Fatalf("read back %q, %v, want %q", got, err, word)
+		}
+		conn.Close()
+	}
+
+	// A failed connection marks the stream, it is never redialed
+	conn := NewAutoReconnectTCP(ep)
+	go io.ReadFull(outR, make([]byte, 1))
+	if err := connWrite(conn, []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	conn.handleErr(errors.New("unexpected reply"))
+	if stdioPipe.failed() == nil {
+		t.Error("pipe still usable after an error")
+	}
+}
+
+func TestParseVsock(t *testing.T) {
+	tests := []struct {
+		in        string
+		cid, port uint32
+		wantErr   bool
+	}{
+		{"3:5000", 3, 5000, false},
+		{"any:5000", vsockCIDAny, 5000, false},
+		{"host:1024", vsockCIDHost, 1024, false},
+		{"local:7", vsockCIDLocal, 7, false},
+		{"5000", 0, 0, true},
+		{"x:5000", 0, 0, true},
+		{"3:port", 0, 0, true},
+	}
+	for _, tt := range tests {
+		cid, port, err := parseVsock(tt.in)
+		if (err != nil) != tt.wantErr || cid != tt.cid || port != tt.port {
+			t.Errorf("parseVsock(%q) = %d, %d, %v, want %d, %d, err=%v", tt.in, cid, port, err, tt.cid, tt.port, tt.wantErr)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := t.TempDir() + "/bsync.sock"
+	socketPerm = 0660
+	defer func() { socketPerm = 0 }()
+
+	l, name, err := listen("0.0.0.0", unixPrefix+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != unixPrefix+path {
+		t.Errorf("listen() name = %q", name)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode = %v, %v, want 0660", fi.Mode().Perm(), err)
+	}
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Write([]byte("ok"))
+			c.Close()
+		}
+	}()
+
+	ep, err := resolveEndpoint(unixPrefix + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewAutoReconnectTCP(ep)
+	got := make([]byte, 2)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ok" {
+		t.Errorf("read %q, %v over the unix socket", got, err)
+	}
+	conn.Close()
+
+	// A live socket is not taken over
+	if _, _, err := listen("0.0.0.0", unixPrefix+path); err == nil {
+		t.Error("listen() took over a socket in use")
+	}
+	l.Close()
+
+	// One left behind by a dead server is replaced
+	f, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.(*net.UnixListener).SetUnlinkOnClose(false)
+	f.Close()
+	l, _, err = listen("0.0.0.0", unixPrefix+path)
+	if err != nil {
+		t.Fatalf("listen() over a stale socket: %v", err)
+	}
+	l.Close()
+}
+
+func TestSortFamily(t *testing.T) {
+	ips := func(s ...string) []net.IPAddr {
+		var out []net.IPAddr
+		for _, a := range s {
+			out = append(out, net.IPAddr{IP: net.ParseIP(a)})
+		}
+		return out
+	}
+	str := func(addrs []net.IPAddr) string {
+		var out []string
+		for _, a := range addrs {
+			out = append(out, a.String())
+		}
+		return strings.Join(out, " ")
+	}
+	tests := []struct {
+		family string
+		want   string
+	}{
+		{"auto", "2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2"},
+		{"4", "192.0.2.1 192.0.2.2 2001:db8::1 2001:db8::2"},
+		{"6", "2001:db8::1 2001:db8::2 192.0.2.1 192.0.2.2"},
+	}
+	for _, tt := range tests {
+		got := str(sortFamily(ips("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"), tt.family))
+		if got != tt.want {
+			t.Errorf("sortFamily(%s) = %s, want %s", tt.family, got, tt.want)
+		}
+	}
+}
+
+func TestListenDualStack(t *testing.T) {
+	l, bindTo, err := listen("0.0.0.0", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if bindTo != ":0" {
+		t.Errorf("listen() bindTo = %q, want :0", bindTo)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		if host == "::1" {
+			if c, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+				t.Log("no IPv6 loopback, skipping ::1")
+				continue
+			} else {
+				c.Close()
+			}
+		}
+		ep, err := resolveEndpoint(net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := ep.dial()
+		if err != nil {
+			t.Errorf("dial %s: %v", host, err)
+			continue
+		}
+		c.Close()
+	}
+}
+
+func TestPathSetRebalance(t *testing.T) {
+	ps, err := newPathSet("127.0.0.1:1,127.0.0.1:2,127.0.0.1:3", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := func() string { return fmt.Sprint(ps.workerCounts()) }
+	if got := counts(); got != "[2 2 2]" {
+		t.Fatalf("workers per path = %s, want [2 2 2]", got)
+	}
+
+	// Path 2 is much slower per worker than path 0: one worker moves
+	atomic.StoreUint64(&ps.paths[0].bytes, 20*1024*1024)
+	atomic.StoreUint64(&ps.paths[1].bytes, 16*1024*1024)
+	atomic.StoreUint64(&ps.paths[2].bytes, 2*1024*1024)
+	ps.rebalance(time.Second)
+	if got := counts(); got != "[3 2 1]" {
+		t.Errorf("after a slow path: %s, want [3 2 1]", got)
+	}
+
+	// Too little traffic to compare: nothing moves
+	atomic.StoreUint64(&ps.paths[0].bytes, 3000)
+	ps.rebalance(time.Second)
+	if got := counts(); got != "[3 2 1]" {
+		t.Errorf("without traffic: %s, want [3 2 1]", got)
+	}
+
+	// A failed path hands its workers to the others
+	ps.fail(0, errors.New("connection reset"))
+	if got := counts(); got != "[0 3 3]" {
+		t.Errorf("after a failure: %s, want [0 3 3]", got)
+	}
+	if ps.order()[2] != 0 {
+		t.Errorf("order() = %v, want the failed path last", ps.order())
+	}
+
+	// Back after pathRetry: it gets a worker again
+	ps.paths[0].downUntil = time.Now().Add(-time.Second)
+	ps.rebalance(time.Second)
+	if got := counts(); got != "[1 2 3]" {
+		t.Errorf("after recovery: %s, want one worker back on path 0", got)
+	}
+}
+
+func TestProgressRecovered(t *testing.T) {
+	defer func() { prog.failed = nil }()
+	prog.failed = nil
+
+	progressFailed(3)
+	progressFailed(5)
+	progressFailed(3)
+	progressRecovered(3)
+	if n := progressFailedCount(); n != 1 || prog.failed[0] != 5 {
+		t.Errorf("after recovering block 3: %v", prog.failed)
+	}
+	progressRecovered(7)
+	if n := progressFailedCount(); n != 1 {
+		t.Errorf("recovering a block that never failed changed the count to %d", n)
+	}
+}
+
+func TestLoadLimitsFile(t *testing.T) {
+	defer func() {
+		netLimiter.SetBase(0)
+		netLimiter.ResumeSchedule()
+		diskLimiter.SetBase(0)
+		diskLimiter.ResumeSchedule()
+	}()
+
+	path := t.TempDir() + "/limits"
+	os.WriteFile(path, []byte("# evening limits\nbwlimit 5M\n\niolimit 1048576\n"), 0644)
+	if err := loadLimitsFile(path); err != nil {
+		t.Fatalf("loadLimitsFile() error: %v", err)
+	}
+	if net, disk := netLimiter.Rate(), diskLimiter.Rate(); net != 5*1024*1024 || disk != 1048576 {
+		t.Errorf("limits = %d, %d", net, disk)
+	}
+
+	os.WriteFile(path, []byte("bwlimit auto\nbwlimit fast\n"), 0644)
+	if err := loadLimitsFile(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("loadLimitsFile() with a bad rate = %v", err)
+	}
+	if rate := netLimiter.Rate(); rate != 0 {
+		t.Errorf("bwlimit auto left %d", rate)
+	}
+}
+
+func TestCreateSibling(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/disk.img"
+
+	// A new file gets the same permissions as any file created under the umask
+	ref, err := os.OpenFile(dir+"/ref", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Close()
+	want, _ := os.Stat(dir + "/ref")
+
+	f, err := createSibling(path, 0666)
+	if err != nil {
+		t.Fatalf("createSibling() error: %v", err)
+	}
+	defer f.Close()
+	got, _ := f.Stat()
+	if got.Mode() != want.Mode() {
+		t.Errorf("mode = %v, want %v", got.Mode(), want.Mode())
+	}
+	if name := f.Name(); !strings.HasPrefix(name, dir+"/.disk.img.bsync-") {
+		t.Errorf("name = %s", name)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	saved := metrics
+	defer func() { metrics = saved }()
+	metrics.blocksHashed, metrics.blocksCompressed, metrics.bytesSent = 0, 0, 0
+
+	for i := 0; i < 3; i++ {
+		metricAdd(&metrics.blocksHashed, 1)
+		metricAdd(&metrics.bytesSent, 4096)
+	}
+	metricAdd(&metrics.blocksCompressed, 2)
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE bsync_blocks_hashed_total counter\n",
+		"\nbsync_blocks_hashed_total 3\n",
+		"\nbsync_blocks_sent_total{kind=\"compressed\"} 2\n",
+		"\nbsync_wire_bytes_total{direction=\"sent\"} 12288\n",
+		"# TYPE bsync_active_connections gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output lacks %q", want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Memory budget (-max-memory): block buffers for reading, compressing,
+// receiving and decompressing come from one pool shared by every stage,
+// and released buffers are reused instead of allocating one per block.
+// Get, used where a block enters the pipeline (the reader), waits while
+// the budget is spent, so a slow link holds back the compressors and then
+// the reader. Stages finishing a block that is already in the pipeline use
+// GetInFlight, which may also take the reserve kept for them: they never
+// wait for the reader, and the pipeline cannot lock up on its own buffers.
+// Server connections take their buffers per message, in a single
+// GetInFlight, and hold none between messages.
+var maxMemory string
+
+// Blocks kept back from Get: one for in-flight stages, one for the zero buffer
+const bufReserveBlocks = 2
+
+type bufferPool struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	limit     int64 // 0: unlimited
+	reserve   int64 // part of limit only GetInFlight may use
+	inUse     int64 // bytes of buffers handed out
+	allocated int64 // bytes of all pool buffers, in use or free
+	peak      int64
+	waits     uint64 // Gets that had to wait for the budget
+	warned    bool
+	free      [][]byte
+}
+
+var bufPool = newBufferPool(0, 0)
+
+func newBufferPool(limit, reserve int64) *bufferPool {
+	p := &bufferPool{limit: limit, reserve: reserve}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// setupMemory parses -max-memory and checks it leaves room for the workers
+func setupMemory(s string, blockSize uint32, workers int) {
+	if s == "" {
+		return
+	}
+	limit, err := parseRate(s)
+	if err != nil {
+		Err("invalid -max-memory: %s\n", s)
+	}
+	if limit == 0 {
+		return
+	}
+	reserve := int64(bufReserveBlocks) * int64(blockSize)
+	need := uint64(workers+1)*uint64(blockSize) + uint64(reserve)
+	if limit < need {
+		Err("-max-memory %s is too small for -b %d with -w %d, at least %d bytes are needed\n", s, blockSize, workers, need)
+	}
+	bufPool = newBufferPool(int64(limit), reserve)
+	Log("memory budget: %d bytes of block buffers (%d blocks)\n", limit, limit/uint64(blockSize))
+}
+
+// Get returns an aligned buffer of size bytes for a new block, waiting
+// while the budget outside the reserve is in use
+func (p *bufferPool) Get(size int) []byte {
+	return p.get(size, p.limit-p.reserve)
+}
+
+// GetInFlight returns a buffer for a block already in the pipeline
+func (p *bufferPool) GetInFlight(size int) []byte {
+	return p.get(size, p.limit)
+}
+
+func (p *bufferPool) get(size int, limit int64) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	waited := false
+	for {
+		// A block that does not fit even when nothing is in use (a client
+		// using a larger -b than the server's) is served over the budget
+		over := p.limit > 0 && p.inUse == 0 && int64(size) > limit
+		if over && !p.warned {
+			p.warned = true
+			Warn("memory: %d byte buffers do not fit in -max-memory %d, going over it\n", size, p.limit)
+		}
+		fits := func(n int64) bool { return p.limit == 0 || over || p.inUse+n <= limit }
+
+		// Smallest free buffer that fits
+		best := -1
+		for i, b := range p.free {
+			if cap(b) >= size && (best < 0 || cap(b) < cap(p.free[best])) {
+				best = i
+			}
+		}
+		if best >= 0 && fits(int64(cap(p.free[best]))) {
+			b := p.free[best]
+			p.free[best] = p.free[len(p.free)-1]
+			p.free = p.free[:len(p.free)-1]
+			p.inUse += int64(cap(b))
+			return b[:size]
+		}
+
+		if fits(int64(size)) {
+			// Free buffers that are too small (or too large) make room
+			for len(p.free) > 0 && p.limit > 0 && !over && p.allocated+int64(size) > p.limit {
+				n := len(p.free) - 1
+				p.allocated -= int64(cap(p.free[n]))
+				p.free = p.free[:n]
+			}
+			if p.limit == 0 || over || p.allocated+int64(size) <= p.limit {
+				p.allocated += int64(size)
+				p.inUse += int64(size)
+				if p.allocated > p.peak {
+					p.peak = p.allocated
+				}
+				return alignedBuf(size)
+			}
+		}
+
+		if !waited {
+			waited = true
+			atomic.AddUint64(&p.waits, 1)
+		}
+		p.cond.Wait()
+	}
+}
+
+// Put returns a buffer from Get or GetInFlight for reuse; nil is ignored
+func (p *bufferPool) Put(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	p.mu.Lock()
+	p.inUse -= int64(cap(buf))
+	p.free = append(p.free, buf[:cap(buf)])
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// Discard gives up a pool buffer that is not to be reused
+func (p *bufferPool) Discard(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	p.mu.Lock()
+	p.inUse -= int64(cap(buf))
+	p.allocated -= int64(cap(buf))
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// stats returns the bytes held by the pool, its peak and the waits
+func (p *bufferPool) stats() (allocated, peak int64, waits uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.allocated, p.peak, atomic.LoadUint64(&p.waits)
+}
+
+// logMemory logs the pool summary
+func logMemory() {
+	_, peak, waits := bufPool.stats()
+	if bufPool.limit == 0 {
+		Debug("memory: peak %d bytes of block buffers\n", peak)
+		return
+	}
+	Log("memory: peak %d of %d bytes of block buffers, %d waits for the budget\n", peak, bufPool.limit, waits)
+}
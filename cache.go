@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// Page cache policy (-cache) for the file being synced:
+// normal   - read and write through the page cache
+// dontneed - use the page cache, but drop every block after use
+// direct   - O_DIRECT with aligned buffers, dontneed for unaligned I/O
+//
+// Direct I/O falls back to dontneed for the file's tail and when the
+// filesystem refuses O_DIRECT.
+var cacheMode = "normal"
+
+const directAlign = 4096 // covers 512-byte and 4K logical sectors
+
+// O_DIRECT handles opened by setupCache, *os.File -> *os.File
+var directFiles sync.Map
+
+// Aligned bounce buffers for writing data that lives in unaligned memory
+var bouncePool sync.Pool
+
+func setCacheMode(mode string) {
+	switch mode {
+	case "normal", "dontneed", "direct":
+		cacheMode = mode
+	default:
+		Err("unknown cache mode: %s (use normal, dontneed, direct)\n", mode)
+	}
+}
+
+// setupCache opens the O_DIRECT twin of file used by readAt and writeAt
+func setupCache(file *os.File, writable bool) {
+	if cacheMode == "normal" {
+		return
+	}
+	if writable {
+		disableReadahead(file)
+	}
+	if cacheMode != "direct" {
+		return
+	}
+	if blockSize%directAlign != 0 {
+		Warn("direct I/O needs a block size multiple of %d, dropping the page cache instead\n", directAlign)
+		return
+	}
+	direct, err := openDirect(file.Name(), writable)
+	if err != nil {
+		Warn("direct I/O not available on %s: %s, dropping the page cache instead\n", file.Name(), err)
+		return
+	}
+	directFiles.Store(file, direct)
+	Log("direct I/O enabled on %s\n", file.Name())
+}
+
+func directTwin(file *os.File) *os.File {
+	if direct, ok := directFiles.Load(file); ok {
+		return direct.(*os.File)
+	}
+	return nil
+}
+
+// alignedBuf returns a buffer of size bytes starting on a directAlign boundary
+func alignedBuf(size int) []byte {
+	buf := make([]byte, size+directAlign)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % directAlign); rem != 0 {
+		shift = directAlign - rem
+	}
+	return buf[shift : shift+size : shift+size]
+}
+
+func isAlignedIO(buf []byte, off int64) bool {
+	return len(buf) > 0 && off%directAlign == 0 && len(buf)%directAlign == 0
+}
+
+func isAlignedMem(buf []byte) bool {
+	return uintptr(unsafe.Pointer(&buf[0]))%directAlign == 0
+}
+
+// readAt reads through the O_DIRECT twin when buf and off allow it,
+// otherwise through the page cache, dropping the range unless -cache normal
+func readAt(file *os.File, buf []byte, off int64) (int, error) {
+	if direct := directTwin(file); direct != nil && isAlignedIO(buf, off) && isAlignedMem(buf) {
+		return directRead(direct, buf, off)
+	}
+	n, err := file.ReadAt(buf, off)
+	if cacheMode != "normal" && n > 0 {
+		dropCache(file, off, int64(n), false)
+	}
+	return n, err
+}
+
+// writeAt is readAt for writes; unaligned memory is copied to a bounce buffer
+func writeAt(file *os.File, buf []byte, off int64) (int, error) {
+	if direct := directTwin(file); direct != nil && isAlignedIO(buf, off) {
+		if !isAlignedMem(buf) {
+			bounce, _ := bouncePool.Get().([]byte)
+			if cap(bounce) < len(buf) {
+				bounce = alignedBuf(len(buf))
+			}
+			bounce = bounce[:len(buf)]
+			copy(bounce, buf)
+			defer bouncePool.Put(bounce)
+			buf = bounce
+		}
+		return directWrite(direct, buf, off)
+	}
+	n, err := file.WriteAt(buf, off)
+	if cacheMode != "normal" && n > 0 {
+		dropCache(file, off, int64(n), true)
+	}
+	return n, err
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func openDirect(name string, writable bool) (*os.File, error) {
+	flags := os.O_RDONLY
+	if writable {
+		flags = os.O_RDWR
+	}
+	return os.OpenFile(name, flags|syscall.O_DIRECT, 0)
+}
+
+// directRead uses pread directly: os.File.ReadAt would retry a short read at
+// EOF from an unaligned offset, which O_DIRECT rejects
+func directRead(file *os.File, buf []byte, off int64) (int, error) {
+	fd := int(file.Fd())
+	total := 0
+	for total < len(buf) {
+		n, err := unix.Pread(fd, buf[total:], off+int64(total))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return total, &os.PathError{Op: "pread", Path: file.Name(), Err: err}
+		}
+		if n == 0 {
+			return total, io.EOF
+		}
+		total += n
+		if n%directAlign != 0 {
+			return total, io.EOF // short unaligned read only happens at EOF
+		}
+	}
+	return total, nil
+}
+
+func directWrite(file *os.File, buf []byte, off int64) (int, error) {
+	fd := int(file.Fd())
+	total := 0
+	for total < len(buf) {
+		n, err := unix.Pwrite(fd, buf[total:], off+int64(total))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return total, &os.PathError{Op: "pwrite", Path: file.Name(), Err: err}
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// dropCache evicts the range from the page cache; written pages are flushed
+// first, DONTNEED skips dirty pages
+func dropCache(file *os.File, off, length int64, written bool) {
+	fd := int(file.Fd())
+	if written {
+		unix.SyncFileRange(fd, off, length,
+			unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+	}
+	unix.Fadvise(fd, off, length, unix.FADV_DONTNEED)
+}
+
+// disableReadahead stops the kernel from reading ahead into blocks that were
+// already written and dropped, pulling them back into the cache
+func disableReadahead(file *os.File) {
+	unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_RANDOM)
+}
+
+// syncData is fdatasync: file data and the metadata needed to read it back
+func syncData(file *os.File) error {
+	return unix.Fdatasync(int(file.Fd()))
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openDirect(name string, writable bool) (*os.File, error) {
+	return nil, errors.New("O_DIRECT is only supported on Linux")
+}
+
+func directRead(file *os.File, buf []byte, off int64) (int, error) {
+	return file.ReadAt(buf, off)
+}
+
+func directWrite(file *os.File, buf []byte, off int64) (int, error) {
+	return file.WriteAt(buf, off)
+}
+
+// dropCache is a no-op without posix_fadvise
+func dropCache(file *os.File, off, length int64, written bool) {}
+
+func disableReadahead(file *os.File) {}
+
+func syncData(file *os.File) error {
+	return file.Sync()
+}
@@ -1,15 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"hash"
 	"hash/fnv"
 	"sync"
 	"os"
 	"io"
+	"time"
 )
 
 var zeroBlockHash = make([]byte, 16) // FNV-128a length
 
+// Markers sent in place of a hash, same length so the client stays in sync
+var (
+	eofBlockHash = []byte("bsync:eof-block!") // block is past the destination's end
+	refusedHash  = []byte("bsync:refused!!!") // server refused the transfer, see its log
+	copiedHash   = []byte("bsync:copied!!!!") // server filled the block from its own data (-dedup)
+
+	unreadableHash = []byte("bsync:unreadable") // destination block could not be read, never matches
+
+	doneAckHash      = []byte("bsync:done-ok!!!") // DONE reply: destination written and synced
+	dictAckHash      = []byte("bsync:dict-ok!!!") // dictionary reply: loaded, compressed blocks may use it
+	finishFailedHash = []byte("bsync:finish-err") // DONE reply: sync, verify or replace failed, see server log
+)
+
 // Hasher pool for better performance
 var hasherPool = sync.Pool{
 	New: func() interface{} {
@@ -24,7 +39,9 @@ type PrecomputedBlock struct {
 	Data          []byte // Original data
 	Compressed    []byte // Compressed data (if beneficial)
 	UseCompressed bool   // Whether to use compressed version
+	Codec         uint8  // Codec of Compressed
 	IsZero        bool
+	buf           []byte // pool buffer behind Data or Compressed, released once sent
 }
 
 // compute FNV1a checksum
@@ -36,32 +53,128 @@ func checksum(data []byte) []byte {
 	return hasher.Sum(nil)
 }
 
+// ChecksumCache holds block hashes in pages of cachePageSlots, allocated as
+// blocks are set. A waiter sleeps on a channel of its own slot, so Set only
+// wakes the connection waiting for that block. On large devices the cache
+// keeps a window: the hashing workers run at most window blocks ahead of the
+// highest block asked for (WaitRoom), and pages that fell window blocks
+// behind it are evicted, so the cache stays near 2*window entries however
+// large the device. Evicted blocks read back as nil from WaitFor.
+const (
+	cachePageSlots = 4096
+	cacheWindow    = 1 << 20 // blocks on each side of the consumer, 16 MB of hashes
+)
+
+type cachePage struct {
+	sums  [cachePageSlots][16]byte
+	ready [cachePageSlots / 64]uint64
+}
+
 type ChecksumCache struct {
-	data  map[uint32][]byte
-	ready map[uint32]bool
-	mu    sync.Mutex
-	cond  *sync.Cond
-	maxId uint32
+	pages   []*cachePage
+	waiters map[uint32]chan struct{} // slots someone waits for
+	index   map[[16]byte]uint32      // hash -> a block holding it, for -dedup
+	mu      sync.Mutex
+	maxId   uint32
+	window  uint32        // 0: keep every hash
+	high    uint32        // highest block asked for
+	evicted uint32        // pages below this one are gone
+	room    chan struct{} // closed when high moves, wakes WaitRoom
 }
 
 func NewChecksumCache(maxId uint32) *ChecksumCache {
 	cc := &ChecksumCache{
-		data:   make(map[uint32][]byte),
-		ready:  make(map[uint32]bool),
-		maxId: maxId,
+		pages:   make([]*cachePage, maxId/cachePageSlots+1),
+		waiters: make(map[uint32]chan struct{}),
+		index:   make(map[[16]byte]uint32),
+		maxId:   maxId,
+		room:    make(chan struct{}),
+	}
+	// -verify compares every block at the end, it needs all of them
+	if uint64(maxId)+1 > 2*cacheWindow && !verifyBlocks {
+		cc.window = cacheWindow
+		Log("checksum cache: %d blocks, keeping a window of %d around the transfer\n", uint64(maxId)+1, cc.window)
 	}
-	cc.cond = sync.NewCond(&cc.mu)
 	return cc
 }
 
+// page returns the page of idx and the slot in it, allocating the page
+// when alloc is set; nil if it is not there or evicted. Caller holds mu.
+func (cc *ChecksumCache) page(idx uint32, alloc bool) (*cachePage, int) {
+	p, i := idx/cachePageSlots, int(idx%cachePageSlots)
+	if p < cc.evicted {
+		return nil, i
+	}
+	for int(p) >= len(cc.pages) {
+		if !alloc {
+			return nil, i
+		}
+		cc.pages = append(cc.pages, nil)
+	}
+	if cc.pages[p] == nil && alloc {
+		cc.pages[p] = &cachePage{}
+	}
+	return cc.pages[p], i
+}
+
+func (pg *cachePage) isReady(i int) bool {
+	return pg != nil && pg.ready[i/64]&(1<<(i%64)) != 0
+}
+
 func (cc *ChecksumCache) Set(idx uint32, checksum []byte) {
 	cc.mu.Lock()
-  defer cc.mu.Unlock()
-	cc.data[idx] = checksum
-	cc.ready[idx] = true
-	cc.cond.Broadcast()
+	defer cc.mu.Unlock()
+	pg, i := cc.page(idx, true)
+	if pg == nil {
+		return // behind the window, nobody asks for it again
+	}
+	if pg.isReady(i) {
+		cc.unindex(idx, pg.sums[i][:])
+	}
+	copy(pg.sums[i][:], checksum)
+	pg.ready[i/64] |= 1 << (i % 64)
+	if key, ok := indexKey(checksum); ok {
+		cc.index[key] = idx
+	}
+	if ch, ok := cc.waiters[idx]; ok {
+		close(ch)
+		delete(cc.waiters, idx)
+	}
+}
+
+// Find returns a block whose cached checksum is hash
+func (cc *ChecksumCache) Find(hash []byte) (uint32, bool) {
+	key, ok := indexKey(hash)
+	if !ok {
+		return 0, false
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	idx, ok := cc.index[key]
+	return idx, ok
+}
+
+// unindex drops idx from the index if it is the block listed for its old
+// checksum; caller holds mu
+func (cc *ChecksumCache) unindex(idx uint32, old []byte) {
+	if key, ok := indexKey(old); ok && cc.index[key] == idx {
+		delete(cc.index, key)
+	}
+}
+
+// indexKey rejects the zero, EOF and unreadable markers: only real
+// content is worth copying from
+func indexKey(hash []byte) ([16]byte, bool) {
+	var key [16]byte
+	if len(hash) != len(key) || bytes.Equal(hash, zeroBlockHash) || bytes.Equal(hash, eofBlockHash) ||
+		bytes.Equal(hash, unreadableHash) {
+		return key, false
+	}
+	copy(key[:], hash)
+	return key, true
 }
 
+// WaitFor returns the checksum of idx once it is set; nil if it was evicted
 func (cc *ChecksumCache) WaitFor(idx uint32) []byte {
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
@@ -70,20 +183,110 @@ func (cc *ChecksumCache) WaitFor(idx uint32) []byte {
 		// Out of bounds — return placeholder or nil
 		return make([]byte, 16) // all-zero hash
 	}
+	cc.advance(idx)
+
+	var start time.Time
+	for {
+		pg, i := cc.page(idx, false)
+		if pg.isReady(i) {
+			if !start.IsZero() {
+				metricHashWait(time.Since(start))
+			}
+			return append([]byte(nil), pg.sums[i][:]...)
+		}
+		if idx/cachePageSlots < cc.evicted {
+			return nil
+		}
+		if start.IsZero() {
+			start = time.Now()
+		}
+		ch, ok := cc.waiters[idx]
+		if !ok {
+			ch = make(chan struct{})
+			cc.waiters[idx] = ch
+		}
+		cc.mu.Unlock()
+		<-ch
+		cc.mu.Lock()
+	}
+}
+
+// Advance notes that the transfer reached idx, evicting what fell behind
+// the window
+func (cc *ChecksumCache) Advance(idx uint32) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.advance(idx)
+}
 
-	for !cc.ready[idx] {
-		cc.cond.Wait()
+func (cc *ChecksumCache) advance(idx uint32) {
+	if idx <= cc.high {
+		return
+	}
+	cc.high = idx
+	close(cc.room)
+	cc.room = make(chan struct{})
+	if cc.window == 0 || idx < cc.window {
+		return
 	}
 
-	return cc.data[idx]
+	limit := (idx - cc.window) / cachePageSlots // first page to keep
+	for ; cc.evicted < limit; cc.evicted++ {
+		if int(cc.evicted) >= len(cc.pages) {
+			continue
+		}
+		if pg := cc.pages[cc.evicted]; pg != nil {
+			for i := 0; i < cachePageSlots; i++ {
+				if pg.isReady(i) {
+					cc.unindex(cc.evicted*cachePageSlots+uint32(i), pg.sums[i][:])
+				}
+			}
+			cc.pages[cc.evicted] = nil
+		}
+		// Nobody will set these any more
+		for slot, ch := range cc.waiters {
+			if slot/cachePageSlots == cc.evicted {
+				close(ch)
+				delete(cc.waiters, slot)
+			}
+		}
+	}
 }
 
-// Delete removes a cached checksum to free memory (optional cleanup)
+// WaitRoom holds the hashing workers back until idx is within the window
+// ahead of the transfer
+func (cc *ChecksumCache) WaitRoom(idx uint32) {
+	cc.mu.Lock()
+	for cc.window > 0 && idx >= cc.high+cc.window {
+		room := cc.room
+		cc.mu.Unlock()
+		<-room
+		cc.mu.Lock()
+	}
+	cc.mu.Unlock()
+}
+
+// Get returns a checksum without waiting, ok is false if it was never set
+func (cc *ChecksumCache) Get(idx uint32) ([]byte, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	pg, i := cc.page(idx, false)
+	if !pg.isReady(i) {
+		return nil, false
+	}
+	return append([]byte(nil), pg.sums[i][:]...), true
+}
+
+// Delete removes a cached checksum
 func (cc *ChecksumCache) Delete(idx uint32) {
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
-	delete(cc.data, idx)
-	delete(cc.ready, idx)
+	pg, i := cc.page(idx, false)
+	if !pg.isReady(i) {
+		return
+	}
+	cc.unindex(idx, pg.sums[i][:])
+	pg.ready[i/64] &^= 1 << (i % 64)
 }
 
 // precomputeChecksumsParallel uses channel-based reader for parallel checksum + compression
@@ -102,31 +305,47 @@ func precomputeChecksumsParallel(reader *SequentialReader, cache *ChecksumCache,
 				var isZero bool
 				var compressed []byte
 				var useCompressed bool
+				var codec uint8
 				var originalData []byte
+				var buf []byte
 
-				if isZeroBlock(block.Data) {
+				if block.Zero || isZeroBlock(block.Data) {
 					hash = zeroBlockHash
 					isZero = true
+					bufPool.Put(block.Data)
 				} else {
 					hash = checksum(block.Data)
 					isZero = false
 
 					// Compress the block
-					comp, err := compressData(block.Data)
+					var comp []byte
+					var id uint8
+					var out []byte
+					err := errIncompressible
+					if worthCompressing(block.BlockIdx, block.Data) {
+						out = bufPool.GetInFlight(compressBound(len(block.Data)))
+						comp, id, err = compressData(out, block.Data)
+					}
 					if err == nil && len(comp) < len(block.Data) {
 						compressed = comp
 						useCompressed = true
+						codec = id
 						// Don't need original data if using compressed - save memory
 						originalData = nil
+						bufPool.Put(block.Data)
+						buf = out
 					} else {
 						compressed = nil
 						useCompressed = false
 						originalData = block.Data
+						bufPool.Put(out)
+						buf = block.Data
 					}
 				}
 
 				// Store hash in cache for processBlockJob to use
 				cache.Set(block.BlockIdx, hash)
+				metricAdd(&metrics.blocksHashed, 1)
 
 				// Send precomputed block to transfer workers
 				precompressedChan <- PrecomputedBlock{
@@ -135,7 +354,9 @@ func precomputeChecksumsParallel(reader *SequentialReader, cache *ChecksumCache,
 					Data:          originalData,
 					Compressed:    compressed,
 					UseCompressed: useCompressed,
+					Codec:         codec,
 					IsZero:        isZero,
+					buf:           buf,
 				}
 			}
 		}()
@@ -148,6 +369,18 @@ func precomputeChecksumsParallel(reader *SequentialReader, cache *ChecksumCache,
 	}()
 }
 
+// blockHash hashes a block just read from the destination, the way
+// precomputeChecksums does; used for blocks evicted from the cache
+func blockHash(data []byte) []byte {
+	switch {
+	case len(data) == 0:
+		return eofBlockHash
+	case isZeroBlock(data):
+		return zeroBlockHash
+	}
+	return checksum(data)
+}
+
 // Note: precomputeChecksumsSequential removed - use precomputeChecksumsParallel instead
 
 
@@ -156,25 +389,35 @@ func precomputeChecksums(file *os.File, blockSize uint32, lastBlockNum uint32, c
 
 	jobs := make(chan uint32, workers*2)
 	var wg sync.WaitGroup
+	holes := loadDataMap(file)
 
 	// Start worker goroutines
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			buf := make([]byte, blockSize)
+			buf := bufPool.Get(int(blockSize))
+			defer bufPool.Put(buf)
 			for idx := range jobs {
 				offset := int64(idx) * int64(blockSize)
-				n, err := file.ReadAt(buf, offset)
+				if holes.isHole(offset, int64(blockSize)) {
+					metricAdd(&metrics.blocksHashed, 1)
+					cache.Set(idx, zeroBlockHash)
+					continue
+				}
+				diskLimiter.Wait(len(buf))
+				n, err := readAt(file, buf, offset)
 				if err != nil && err != io.EOF {
-					cache.Set(idx, []byte("ERR"))
+					Warn("checksums: reading block %d: %s\n", idx, err)
+					cache.Set(idx, unreadableHash)
 					continue
 				}
 				if n == 0 && err == io.EOF {
-					cache.Set(idx, []byte("EOF"))
+					cache.Set(idx, eofBlockHash)
 					continue
 				}
 
+				metricAdd(&metrics.blocksHashed, 1)
 				if isZeroBlock(buf[:n]) {
 					cache.Set(idx, zeroBlockHash)
 					continue
@@ -186,8 +429,10 @@ func precomputeChecksums(file *os.File, blockSize uint32, lastBlockNum uint32, c
 		}()
 	}
 
-	// Distribute jobs
+	// Distribute jobs, no further than the cache window ahead of the transfer
+	cache.Advance(skipIdx)
 	for idx := skipIdx; idx <= lastBlockNum; idx++ {
+		cache.WaitRoom(idx)
 		jobs <- idx
 	}
 	close(jobs)
@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"sync"
 	"time"
@@ -40,6 +39,11 @@ func printStats(job BlockJob, indicator string, diff, bytes uint32) {
 	}
 	mu.Unlock()
 
+	progressBlock(indicator, blockLen(job.blockIdx, blockSize, v_fileSize), uint64(bytes), diff > 0)
+	if progressJSON() {
+		return
+	}
+
 	blockMb := float64(blockSize) / float64(mb1)
 
 	blocksLeft := float64(lastBlockNum - job.blockIdx)
@@ -69,7 +73,7 @@ func printStats(job BlockJob, indicator string, diff, bytes uint32) {
 	percent := 100 * float64(job.blockIdx) / float64(lastBlockNum)
 	ratio := 100 * float64(totCompSize) / float64(totOrigSize)
 
-	Log("block %d/%d (%0.2f%%) [%s] size=%d ratio=%0.2f %0.2f MB/s ETA=%d %s diffs=%d\r", job.blockIdx, lastBlockNum, percent, indicator, v_fileSize, ratio, mbs, eta, etaUnit, diffs)
+	Progress("block %d/%d (%0.2f%%) [%s] size=%d ratio=%0.2f %0.2f MB/s ETA=%d %s diffs=%d\r", job.blockIdx, lastBlockNum, percent, indicator, v_fileSize, ratio, mbs, eta, etaUnit, diffs)
 }
 
 // startClient launches threadsCount workers, each with a persistent connection, and pushes file blocks to a jobs channel
@@ -82,13 +86,18 @@ func startClient(file *os.File, serverAddress string, skipIdx uint32, fileSize u
 	t0 = time.Now()
 	v_skipIdx = skipIdx
 	v_fileSize = fileSize
+	startProgress("client", fileSize, blockSize, skipIdx)
 
-	// Resolve server address once
-	saddr, err := net.ResolveTCPAddr("tcp", serverAddress)
+	// Resolve the server addresses once, workers are spread over them
+	paths, err := newPathSet(serverAddress, workers)
 	if err != nil {
 		Err("resolving: %s\n", err.Error())
 		return
 	}
+	ep := paths.shared()
+
+	// Train and ship the zstd dictionary before anything is read or compressed
+	setupDictionary(ep, file, blockSize, fileSize)
 
 	// Create sequential reader with channel-based output
 	reader := NewSequentialReader(file, blockSize, fileSize, skipIdx, workers*2)
@@ -98,22 +107,29 @@ func startClient(file *os.File, serverAddress string, skipIdx uint32, fileSize u
 	precompressedChan := make(chan PrecomputedBlock, workers*2)
 
 	// Start parallel checksum + compression workers
+	startAdaptive(workers)
 	go precomputeChecksumsParallel(reader, checksumCache, precompressedChan, workers)
 
-	// Start worker goroutines for network transfer
-	Log("starting %d transfer workers\n", workers)
-	for i := 0; i < workers; i++ {
+	// Start worker goroutines for network transfer, a pipe is one stream
+	conns := workers
+	if paths.pipe() {
+		conns = 1
+	}
+	Log("starting %d transfer workers\n", conns)
+	for i := 0; i < conns; i++ {
 		wg.Add(1)
-		go func(saddr *net.TCPAddr) {
+		go func(w int, wlog *Logger) {
 			defer wg.Done()
-			conn := NewAutoReconnectTCP(saddr)
+			conn := NewAutoReconnectTCP(paths.worker(w))
 			defer conn.Close()
 			for block := range precompressedChan {
+				conn.Rebalance()
 				var lastErr error
 				for retry := 0; retry < maxRetries; retry++ {
 					if retry > 0 {
-						Log("block %d: retry %d/%d after: %v\n", block.BlockIdx, retry, maxRetries-1, lastErr)
-						conn.Close() // force reconnect on next call
+						metricAdd(&metrics.retries, 1)
+						wlog.Warn("block %d: retry %d/%d after: %v\n", block.BlockIdx, retry, maxRetries-1, lastErr)
+						conn.handleErr(lastErr) // force reconnect on next call
 						time.Sleep(time.Duration(retry) * time.Second)
 					}
 					if lastErr = processPrecomputedBlock(conn, block, blockSize, fileSize, noCompress, checksumCache); lastErr == nil {
@@ -121,18 +137,36 @@ func startClient(file *os.File, serverAddress string, skipIdx uint32, fileSize u
 					}
 				}
 				if lastErr != nil {
-					Log("block %d: failed after %d retries: %v\n", block.BlockIdx, maxRetries, lastErr)
+					wlog.Error("block %d: failed after %d retries: %v\n", block.BlockIdx, maxRetries, lastErr)
+					progressFailed(block.BlockIdx)
 				}
+				bufPool.Put(block.buf)
+				checksumCache.Advance(block.BlockIdx)
+				adaptConsumed(blockLen(block.BlockIdx, blockSize, fileSize))
 			}
-		}(saddr)
+		}(i, rootLog.With("worker", i))
 	}
+	paths.start()
 
 	Log("DONE, waiting for the workers\n")
 	wg.Wait()
+	paths.stopPaths()
+	stopAdaptive()
+	logCompressSavings()
+
+	if dryRun {
+		probe := NewAutoReconnectTCP(ep)
+		if err := dryRunProbe(probe, blockSize, fileSize); err != nil {
+			Warn("dry-run: link rate probe failed: %s\n", err)
+		}
+		probe.Close()
+		printDryRunReport(dryRunResult(), lastBlockNum-skipIdx+1)
+	}
+	rescueFinish()
 
 	// Send DONE message to server
 	magicBytes := stringToFixedSizeArray(magicHead)
-	conn := NewAutoReconnectTCP(saddr)
+	conn := NewAutoReconnectTCP(ep)
 	defer conn.Close()
 	msg, err1 := pack(&Msg{
 		MagicHead:  magicBytes,
@@ -143,21 +177,32 @@ func startClient(file *os.File, serverAddress string, skipIdx uint32, fileSize u
 		Compressed: false,
 		Zero:       false,
 		Done:       true,
+		DryRun:     dryRun,
 	})
 	if err1 != nil {
-		Log("cant pack msg-> %s\n", err1)
+		Error("cant pack msg-> %s\n", err1)
 		return
 	}
 
 	n, err2 := conn.Write(msg)
 	if err2 != nil && err2 != io.EOF {
-		Log("\t- error writing net: [%d] %s\n", n, err2.Error())
+		Error("\t- error writing net: [%d] %s\n", n, err2.Error())
 		return
 	}
 
-	Log("\nDONE, exiting..\n\n")
-	time.Sleep(2 * time.Second)
-	return
+	// The server replies once the destination is written and synced
+	ack := make([]byte, len(doneAckHash))
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		Err("no DONE acknowledgement from server: %s\n", err)
+	}
+	if bytes.Equal(ack, finishFailedHash) {
+		Err("destination sync, verify or replace failed, see the server log\n")
+	}
+	if !bytes.Equal(ack, doneAckHash) {
+		Err("unexpected DONE acknowledgement from server: %x\n", ack)
+	}
+
+	Log("\nDONE acknowledged by server, exiting..\n\n")
 }
 
 // processPrecomputedBlock sends a pre-hashed and pre-compressed block.
@@ -165,8 +210,8 @@ func startClient(file *os.File, serverAddress string, skipIdx uint32, fileSize u
 func processPrecomputedBlock(conn *AutoReconnectTCP, block PrecomputedBlock, blockSize uint32, fileSize uint64, noCompress bool, checksumCache *ChecksumCache) error {
 	magicBytes := stringToFixedSizeArray(magicHead)
 
-	// Send request to server
-	msg, err1 := pack(&Msg{
+	// Send request to server, with our hash so it can reuse matching data
+	req := &Msg{
 		MagicHead:  magicBytes,
 		BlockIdx:   block.BlockIdx,
 		BlockSize:  blockSize,
@@ -175,7 +220,10 @@ func processPrecomputedBlock(conn *AutoReconnectTCP, block PrecomputedBlock, blo
 		Compressed: false,
 		Zero:       false,
 		Done:       false,
-	})
+		DryRun:     dryRun,
+	}
+	copy(req.Hash[:], block.Hash)
+	msg, err1 := pack(req)
 	if err1 != nil {
 		return fmt.Errorf("pack: %w", err1)
 	}
@@ -189,14 +237,47 @@ func processPrecomputedBlock(conn *AutoReconnectTCP, block PrecomputedBlock, blo
 	if _, err := io.ReadFull(conn, serverHash); err != nil {
 		return fmt.Errorf("read hash: %w", err)
 	}
+	if bytes.Equal(serverHash, refusedHash) {
+		Err("server refused the transfer (destination size policy), see the server log\n")
+	}
 
 	// Block is already in sync, skip sending
 	if bytes.Equal(block.Hash, serverHash) {
+		metricAdd(&metrics.blocksSkipped, 1)
 		job := BlockJob{blockIdx: block.BlockIdx, data: block.Data, readedBytes: len(block.Data)}
 		printStats(job, "-", 0, 0)
 		return nil
 	}
 
+	// Server copied the block from its own data
+	if bytes.Equal(serverHash, copiedHash) {
+		metricAdd(&metrics.blocksReused, 1)
+		if dryRun {
+			dryRunReused(block.BlockIdx)
+		}
+		job := BlockJob{blockIdx: block.BlockIdx, data: nil, readedBytes: int(blockSize)}
+		printStats(job, "r", 1, 0)
+		return nil
+	}
+
+	// Dry-run: note what would be sent, send nothing
+	if dryRun {
+		job := BlockJob{blockIdx: block.BlockIdx, data: nil, readedBytes: int(blockSize)}
+		switch {
+		case block.IsZero:
+			dryRunRecord(block.BlockIdx, true, 0, 0)
+			printStats(job, ".", 1, 0)
+		case !noCompress && block.UseCompressed:
+			dryRunRecord(block.BlockIdx, false, uint64(len(block.Compressed)), blockLen(block.BlockIdx, blockSize, fileSize))
+			printStats(job, "c", 1, 0)
+		default:
+			raw := blockLen(block.BlockIdx, blockSize, fileSize)
+			dryRunRecord(block.BlockIdx, false, raw, raw)
+			printStats(job, "w", 1, 0)
+		}
+		return nil
+	}
+
 	// Handle zero blocks - send only Msg, NO data (sparse file optimization)
 	if block.IsZero {
 		msg2, err1 := pack(&Msg{
@@ -215,6 +296,7 @@ func processPrecomputedBlock(conn *AutoReconnectTCP, block PrecomputedBlock, blo
 		if err := connWrite(conn, msg2); err != nil {
 			return fmt.Errorf("send zero: %w", err)
 		}
+		metricAdd(&metrics.blocksZero, 1)
 		job := BlockJob{blockIdx: block.BlockIdx, data: nil, readedBytes: int(blockSize)}
 		printStats(job, ".", 1, 0)
 		return nil
@@ -223,6 +305,7 @@ func processPrecomputedBlock(conn *AutoReconnectTCP, block PrecomputedBlock, blo
 	// Determine what to send for non-zero blocks
 	var dataToSend []byte
 	var compressedFlag bool
+	var codec uint8
 
 	if noCompress || !block.UseCompressed {
 		compressedFlag = false
@@ -230,6 +313,7 @@ func processPrecomputedBlock(conn *AutoReconnectTCP, block PrecomputedBlock, blo
 	} else {
 		compressedFlag = true
 		dataToSend = block.Compressed
+		codec = block.Codec
 	}
 
 	if len(dataToSend) == 0 {
@@ -243,6 +327,7 @@ func processPrecomputedBlock(conn *AutoReconnectTCP, block PrecomputedBlock, blo
 		FileSize:   fileSize,
 		DataSize:   uint32(len(dataToSend)),
 		Compressed: compressedFlag,
+		Codec:      codec,
 		Zero:       false,
 		Done:       false,
 	})
@@ -259,8 +344,10 @@ func processPrecomputedBlock(conn *AutoReconnectTCP, block PrecomputedBlock, blo
 
 	job := BlockJob{blockIdx: block.BlockIdx, data: block.Data, readedBytes: len(block.Data)}
 	if compressedFlag {
+		metricAdd(&metrics.blocksCompressed, 1)
 		printStats(job, "c", 1, uint32(len(dataToSend)))
 	} else {
+		metricAdd(&metrics.blocksRaw, 1)
 		printStats(job, "w", 1, uint32(len(dataToSend)))
 	}
 	return nil
@@ -270,15 +357,16 @@ func processPrecomputedBlock(conn *AutoReconnectTCP, block PrecomputedBlock, blo
 func startClientDownload(file *os.File, serverAddress string, skipIdx uint32, blockSize uint32, noCompress bool, workers int) {
 	Log("startClientDownload()\n")
 
-	// Resolve server address once
-	saddr, err := net.ResolveTCPAddr("tcp", serverAddress)
+	// Resolve server address once, several only fail over
+	paths, err := newPathSet(serverAddress, 1)
 	if err != nil {
 		Err("resolving: %s\n", err.Error())
 		return
 	}
+	ep := paths.shared()
 
 	// Connect to server
-	conn := NewAutoReconnectTCP(saddr)
+	conn := NewAutoReconnectTCP(ep)
 	defer conn.Close()
 
 	// Send download request to server
@@ -294,13 +382,13 @@ func startClientDownload(file *os.File, serverAddress string, skipIdx uint32, bl
 		Done:       false,
 	})
 	if err1 != nil {
-		Log("cant pack download request msg-> %s\n", err1)
+		Error("cant pack download request msg-> %s\n", err1)
 		return
 	}
 
 	n, err2 := conn.Write(msg)
 	if err2 != nil && err2 != io.EOF {
-		Log("\t- error writing download request: [%d] %s\n", n, err2.Error())
+		Error("\t- error writing download request: [%d] %s\n", n, err2.Error())
 		return
 	}
 
@@ -308,13 +396,13 @@ func startClientDownload(file *os.File, serverAddress string, skipIdx uint32, bl
 	msgBuf := make([]byte, binary.Size(Msg{}))
 	_, err = io.ReadFull(conn, msgBuf)
 	if err != nil {
-		Log("Error reading metadata from server: %s\n", err.Error())
+		Error("Error reading metadata from server: %s\n", err.Error())
 		return
 	}
 
 	metaMsg, err3 := unpack(msgBuf)
 	if err3 != nil {
-		Log("\t- unpack metadata failed: %s\n", err3)
+		Error("\t- unpack metadata failed: %s\n", err3)
 		return
 	}
 
@@ -327,12 +415,18 @@ func startClientDownload(file *os.File, serverAddress string, skipIdx uint32, bl
 
 	Log("remote file size: %d bytes, block %d bytes, blockNum: %d\n", fileSize, blockSize, lastBlockNum)
 
-	// Truncate local file to match remote size
-	truncateIfRegularFile(file, fileSize)
+	// Check the local size against the remote one before writing anything
+	if err := applySizePolicy(file, fileSize, false); err != nil {
+		Err("size policy %s: %s\n", sizePolicy, err.Error())
+	}
+	startProgress("client-download", fileSize, blockSize, skipIdx)
 
 	// Start receiving blocks
 	Log("start downloading from server\n")
-	filebuf := make([]byte, blockSize)
+	filebuf := bufPool.Get(int(blockSize))
+	defer bufPool.Put(filebuf)
+	outbuf := bufPool.GetInFlight(int(blockSize))
+	defer bufPool.Put(outbuf)
 
 	for blockIdx := uint32(skipIdx); blockIdx <= lastBlockNum; blockIdx++ {
 		// Request block from server
@@ -347,26 +441,26 @@ func startClientDownload(file *os.File, serverAddress string, skipIdx uint32, bl
 			Done:       false,
 		})
 		if err1 != nil {
-			Log("cant pack block request msg-> %s\n", err1)
+			Error("cant pack block request msg-> %s\n", err1)
 			return
 		}
 
 		n, err2 := conn.Write(msg)
 		if err2 != nil && err2 != io.EOF {
-			Log("\t- error writing block request: [%d] %s\n", n, err2.Error())
+			Error("\t- error writing block request: [%d] %s\n", n, err2.Error())
 			return
 		}
 
 		// Read response
 		_, err = io.ReadFull(conn, msgBuf)
 		if err != nil {
-			Log("Error reading block response: %s\n", err.Error())
+			Error("Error reading block response: %s\n", err.Error())
 			return
 		}
 
 		blockMsg, err4 := unpack(msgBuf)
 		if err4 != nil {
-			Log("\t- unpack block response failed: %s\n", err4)
+			Error("\t- unpack block response failed: %s\n", err4)
 			return
 		}
 
@@ -376,12 +470,26 @@ func startClientDownload(file *os.File, serverAddress string, skipIdx uint32, bl
 		}
 
 		offset := int64(blockIdx) * int64(blockSize)
+		indicator := "w"
 
-		// Handle zero blocks (DataSize=0, Zero=true) - no data sent, preserve sparse hole
+		// Handle zero blocks (DataSize=0, Zero=true) - no data sent
 		if blockMsg.Zero && blockMsg.DataSize == 0 {
-			// Don't write anything - file is pre-truncated, creates sparse hole
-			if debug {
-				Log("\t- zero block at %d, skipping write\n", blockIdx)
+			length := int64(blockLen(blockIdx, blockSize, fileSize))
+			n, err := readAt(file, filebuf[:length], offset)
+			if (err == nil || err == io.EOF) && isZeroBlock(filebuf[:n]) {
+				// Already zero (or a hole of the pre-truncated file) - nothing to write
+				Debug("\t- zero block at %d, already zero\n", blockIdx)
+				indicator = "-"
+			} else {
+				Debug("\t- zero block at %d, zeroing (%s)\n", blockIdx, zeroMode)
+				if err := zeroRange(file, offset, length); err != nil {
+					Error("\t- error zeroing block: %s\n", err.Error())
+					metricAdd(&metrics.writeFailures, 1)
+					progressFailed(blockIdx)
+					break
+				}
+				indicator = "."
+				metricAdd(&metrics.blocksZero, 1)
 			}
 		}
 
@@ -389,33 +497,60 @@ func startClientDownload(file *os.File, serverAddress string, skipIdx uint32, bl
 			// Read block data
 			_, err1 := io.ReadFull(conn, filebuf[:blockMsg.DataSize])
 			if err1 != nil {
-				Log("\t- error reading block data: %s\n", err1)
+				Error("\t- error reading block data: %s\n", err1)
 				return
 			}
+			metricAdd(&metrics.bytesReceived, uint64(blockMsg.DataSize))
 
 			if blockMsg.Compressed {
-				decompressed, err := decompressData(filebuf[:blockMsg.DataSize])
+				indicator = "c"
+				decompressed, err := decompressData(outbuf, filebuf[:blockMsg.DataSize], blockMsg.Codec, int(blockLen(blockIdx, blockSize, fileSize)))
 				if err != nil {
-					Log("\t- error decompressing: %s\n", err.Error())
+					Error("\t- error decompressing: %s\n", err.Error())
+					metricAdd(&metrics.decompressFailures, 1)
+					progressFailed(blockIdx)
 					break
 				}
-				n, err2 := file.WriteAt(decompressed, offset)
+				n, err2 := writeAt(file, decompressed, offset)
 				if err2 != nil && err2 != io.EOF {
-					Log("\t- error writing decompressed block: [%d] %s\n", n, err2.Error())
+					Error("\t- error writing decompressed block: [%d] %s\n", n, err2.Error())
+					metricAdd(&metrics.writeFailures, 1)
+					progressFailed(blockIdx)
 					break
 				}
+				metricAdd(&metrics.blocksCompressed, 1)
 			} else {
-				n, err2 := file.WriteAt(filebuf[:blockMsg.DataSize], offset)
+				n, err2 := writeAt(file, filebuf[:blockMsg.DataSize], offset)
 				if err2 != nil && err2 != io.EOF {
-					Log("\t- error writing block: [%d] %s\n", n, err2.Error())
+					Error("\t- error writing block: [%d] %s\n", n, err2.Error())
+					metricAdd(&metrics.writeFailures, 1)
+					progressFailed(blockIdx)
 					break
 				}
+				metricAdd(&metrics.blocksRaw, 1)
+			}
+		}
+
+		if indicator != "-" {
+			if err := syncWritten(file); err != nil {
+				Error("\t- sync failed: %s\n", err.Error())
+				metricAdd(&metrics.writeFailures, 1)
+				progressFailed(blockIdx)
+				break
 			}
 		}
 
+		progressBlock(indicator, blockLen(blockIdx, blockSize, fileSize), uint64(blockMsg.DataSize), true)
+		if progressJSON() {
+			continue
+		}
 		percent := 100 * float64(blockIdx) / float64(lastBlockNum)
-		Log("downloaded block %d/%d (%0.2f%%)\r", blockIdx, lastBlockNum, percent)
+		Progress("downloaded block %d/%d (%0.2f%%)\r", blockIdx, lastBlockNum, percent)
 	}
 
+	if err := syncFile(file); err != nil {
+		Err("final sync failed: %s\n", err.Error())
+	}
+	logSyncStats()
 	Log("\ndownload complete\n")
 }
@@ -1,73 +1,231 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/s2"
 	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Block codecs. Every compressed block carries its codec id in Msg.Codec,
+// so nothing is negotiated: the receiver decodes whatever arrives and the
+// sender picks the codec (-codec, -n for none).
+type Codec interface {
+	Name() string
+	// Encode compresses src at level (compFast..compBest), appending to dst
+	Encode(dst, src []byte, level int) ([]byte, error)
+	// MaxEncodedLen is the room Encode needs in dst for n bytes of src,
+	// with less it may allocate
+	MaxEncodedLen(n int) int
+	// Decode decompresses src, appending to dst; a block that does not
+	// decode to size bytes is an error, found before allocating if possible
+	Decode(dst, src []byte, size int) ([]byte, error)
+}
+
+const (
+	codecNone uint8 = iota
+	codecZstd
+	codecLZ4
+	codecS2
 )
 
+var codecs = map[uint8]Codec{
+	codecZstd: zstdCodec{},
+	codecLZ4:  lz4Codec{},
+	codecS2:   s2Codec{},
+}
+
+// errIncompressible is returned by codecs that give up on data that does
+// not shrink; the block is sent raw
+var errIncompressible = errors.New("data is incompressible")
+
+// Compression levels as named by -L; compOff is only used by -L auto,
+// which skips compression while sampled data does not shrink
+const (
+	compOff = iota
+	compFast
+	compDefault
+	compBetter
+	compBest
+)
+
+var compLevelNames = []string{"off", "fast", "default", "better", "best"}
+
+var zstdLevels = [...]zstd.EncoderLevel{
+	compFast:    zstd.SpeedFastest,
+	compDefault: zstd.SpeedDefault,
+	compBetter:  zstd.SpeedBetterCompression,
+	compBest:    zstd.SpeedBestCompression,
+}
+
 var (
-	encoderLevel zstd.EncoderLevel = zstd.SpeedDefault
-	encoderPool = sync.Pool{
-		New: func() interface{} {
-			enc, err := zstd.NewWriter(nil,
-				zstd.WithEncoderLevel(encoderLevel),
-				zstd.WithWindowSize(1<<18),
-			)
-			if err != nil {
-				panic(err)
-			}
-			return enc
-		},
+	activeCodec  = codecZstd
+	compLevelCur = compDefault
+
+	// zstd pools of the current dictionary, replaced as a whole when it
+	// changes, so a block never meets a coder of another dictionary
+	zstdState atomic.Pointer[zstdPools]
+)
+
+// zstdPools holds zstd encoders, one pool per level, and decoders, all
+// loaded with dict
+type zstdPools struct {
+	encoders [len(zstdLevels)]sync.Pool
+	decoders sync.Pool
+	dict     []byte // session dictionary (-dict), nil without one
+}
+
+func init() {
+	zstdState.Store(newZstdPools(nil))
+}
+
+func newZstdPools(dict []byte) *zstdPools {
+	p := &zstdPools{dict: dict}
+	for level := compFast; level < len(zstdLevels); level++ {
+		opts := []zstd.EOption{
+			zstd.WithEncoderLevel(zstdLevels[level]),
+			zstd.WithWindowSize(1 << 18),
+		}
+		if dict != nil {
+			opts = append(opts, zstd.WithEncoderDict(dict))
+		}
+		p.encoders[level] = sync.Pool{
+			New: func() interface{} {
+				enc, err := zstd.NewWriter(nil, opts...)
+				if err != nil {
+					panic(err)
+				}
+				return enc
+			},
+		}
+	}
+
+	var dopts []zstd.DOption
+	if dict != nil {
+		dopts = append(dopts, zstd.WithDecoderDicts(dict))
 	}
-	decoderPool = sync.Pool{
+	p.decoders = sync.Pool{
 		New: func() interface{} {
-			dec, err := zstd.NewReader(nil)
+			dec, err := zstd.NewReader(nil, dopts...)
 			if err != nil {
 				panic(err)
 			}
 			return dec
 		},
 	}
-	// Buffer pool for decompression output (reduces GC pressure)
-	decompressBufPool = sync.Pool{
-		New: func() interface{} {
-			// Pre-allocate buffer for typical block size (10MB decompressed)
-			return make([]byte, 0, 10*1024*1024)
-		},
-	}
-)
+	return p
+}
 
-// SetCompressionLevel sets the compression level for new encoders
-// Must be called before any compression is done
+// SetCompressionLevel sets the compression level, "auto" lets
+// adaptive.go pick it during the transfer
 func SetCompressionLevel(level string) {
-	switch level {
-	case "fast":
-		encoderLevel = zstd.SpeedFastest
-	case "better":
-		encoderLevel = zstd.SpeedBetterCompression
-	case "best":
-		encoderLevel = zstd.SpeedBestCompression
-	default:
-		encoderLevel = zstd.SpeedDefault
+	compAdaptive = level == "auto"
+	compLevelCur = compDefault
+	atomic.StoreInt32(&adapt.level, compDefault)
+	for i, name := range compLevelNames {
+		if name == level && i != compOff {
+			compLevelCur = i
+		}
 	}
 }
 
-func compressData(data []byte) ([]byte, error) {
-	encoder := encoderPool.Get().(*zstd.Encoder)
-	defer encoderPool.Put(encoder)
+// compLevelName is the -L value that reproduces the current setting
+func compLevelName() string {
+	if compAdaptive {
+		return "auto"
+	}
+	return compLevelNames[compLevelCur]
+}
 
-	buffer := make([]byte, 0, len(data))
-	result := encoder.EncodeAll(data, buffer)
+// setCodec selects the codec used for sending by name
+func setCodec(name string) {
+	if name == "none" {
+		activeCodec = codecNone
+		return
+	}
+	for id, c := range codecs {
+		if c.Name() == name {
+			activeCodec = id
+			return
+		}
+	}
+	Err("unknown codec: %s (use zstd, lz4, s2 or none)\n", name)
+}
+
+// codecName names a codec id for logs
+func codecName(id uint8) string {
+	if c, ok := codecs[id]; ok {
+		return c.Name()
+	}
+	if id == codecNone {
+		return "none"
+	}
+	return fmt.Sprintf("codec-%d", id)
+}
+
+// compressBound is the size of the dst buffer compressData needs for n
+// bytes, so compression stays in pool buffers
+func compressBound(n int) int {
+	if c, ok := codecs[activeCodec]; ok {
+		return c.MaxEncodedLen(n)
+	}
+	return n
+}
+
+// compressData compresses with the active codec into dst, a buffer of
+// compressBound(len(data)) bytes, returning the codec used;
+// errIncompressible (or codecNone) means send the block raw
+func compressData(dst, data []byte) ([]byte, uint8, error) {
+	c, ok := codecs[activeCodec]
+	if !ok {
+		return nil, codecNone, errIncompressible
+	}
+
+	level := compLevelCur
+	if compAdaptive {
+		level = adaptLevel()
+		if level == compOff {
+			if !sampleCompresses(c, dst, data) {
+				adaptRecord(compOff, len(data), len(data), 0)
+				return nil, activeCodec, errIncompressible
+			}
+			level = compFast
+		}
+	}
+
+	start := time.Now()
+	result, err := c.Encode(dst[:0], data, level)
+	elapsed := time.Since(start)
+	compressRecord(len(data), elapsed)
+	if compAdaptive {
+		adaptRecord(level, len(data), len(result), elapsed)
+	}
+	if err != nil {
+		return nil, activeCodec, err
+	}
 
 	// Encrypt after compression if enabled
 	if IsEncryptionEnabled() {
 		result = encryptBlock(result)
 	}
 
-	return result, nil
+	return result, activeCodec, nil
 }
 
-func decompressData(data []byte) ([]byte, error) {
+// decompressData decodes a block of size bytes into dst, a buffer of one
+// block
+func decompressData(dst, data []byte, codec uint8, size int) ([]byte, error) {
+	c, ok := codecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+
 	// Decrypt before decompression if enabled
 	if IsEncryptionEnabled() {
 		decrypted, err := decryptBlock(data)
@@ -77,19 +235,144 @@ func decompressData(data []byte) ([]byte, error) {
 		data = decrypted
 	}
 
-	decoder := decoderPool.Get().(*zstd.Decoder)
-	defer decoderPool.Put(decoder)
+	out, err := c.Decode(dst[:0], data, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("%s: decoded %d bytes, want %d", c.Name(), len(out), size)
+	}
+	return out, nil
+}
 
-	// Get buffer from pool to reduce allocations
-	buf := decompressBufPool.Get().([]byte)
-	buf = buf[:0] // Reset length but keep capacity
+type zstdCodec struct{}
 
-	decompressed, err := decoder.DecodeAll(data, buf)
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) Encode(dst, src []byte, level int) ([]byte, error) {
+	pools := zstdState.Load()
+	encoder := pools.encoders[level].Get().(*zstd.Encoder)
+	defer pools.encoders[level].Put(encoder)
+	return encoder.EncodeAll(src, dst), nil
+}
+
+// MaxEncodedLen is ZSTD_COMPRESSBOUND, for incompressible data stored raw
+func (zstdCodec) MaxEncodedLen(n int) int {
+	bound := n + n>>8
+	if n < 128*1024 {
+		bound += (128*1024 - n) >> 11
+	}
+	return bound
+}
+
+func (zstdCodec) Decode(dst, src []byte, size int) ([]byte, error) {
+	var h zstd.Header
+	if err := h.Decode(src); err != nil {
+		return nil, err
+	}
+	if h.HasFCS && h.FrameContentSize != uint64(size) {
+		return nil, fmt.Errorf("zstd: block declares %d bytes, want %d", h.FrameContentSize, size)
+	}
+	pools := zstdState.Load()
+	decoder := pools.decoders.Get().(*zstd.Decoder)
+	defer pools.decoders.Put(decoder)
+	return decoder.DecodeAll(src, dst)
+}
+
+// lz4Codec uses raw LZ4 blocks prefixed with the decoded length, the block
+// format does not record it
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string { return "lz4" }
+
+func (lz4Codec) Encode(dst, src []byte, level int) ([]byte, error) {
+	// Output that does not fit in len(src) does not shrink: dst only needs
+	// room for that, lz4 gives up with n == 0 beyond it
+	start := len(dst)
+	if need := start + 4 + len(src); cap(dst) < need {
+		dst = append(make([]byte, 0, need), dst...)
+	}
+	dst = dst[:cap(dst)]
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(src)))
+
+	var n int
+	var err error
+	switch level {
+	case compBetter:
+		n, err = lz4.CompressBlockHC(src, dst[start+4:], lz4.Level4, nil, nil)
+	case compBest:
+		n, err = lz4.CompressBlockHC(src, dst[start+4:], lz4.Level9, nil, nil)
+	default:
+		n, err = lz4.CompressBlock(src, dst[start+4:], nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errIncompressible
+	}
+	return dst[:start+4+n], nil
+}
+
+// MaxEncodedLen leaves room for the length prefix and the block itself:
+// output that does not shrink is given up on
+func (lz4Codec) MaxEncodedLen(n int) int { return n + 4 }
+
+func (lz4Codec) Decode(dst, src []byte, size int) ([]byte, error) {
+	if len(src) < 4 {
+		return nil, errors.New("lz4: short block")
+	}
+	if n := binary.LittleEndian.Uint32(src); uint64(n) != uint64(size) {
+		return nil, fmt.Errorf("lz4: block declares %d bytes, want %d", n, size)
+	}
+	start := len(dst)
+	if cap(dst)-start < size {
+		dst = append(make([]byte, 0, start+size), dst...)
+	}
+	n, err := lz4.UncompressBlock(src[4:], dst[start:start+size])
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("lz4: decoded %d bytes, want %d", n, size)
+	}
+	return dst[:start+size], nil
+}
+
+type s2Codec struct{}
+
+func (s2Codec) Name() string { return "s2" }
+
+func (s2Codec) Encode(dst, src []byte, level int) ([]byte, error) {
+	var out []byte
+	switch level {
+	case compBetter:
+		out = s2.EncodeBetter(dst[len(dst):cap(dst)], src)
+	case compBest:
+		out = s2.EncodeBest(dst[len(dst):cap(dst)], src)
+	default:
+		out = s2.Encode(dst[len(dst):cap(dst)], src)
+	}
+	return append(dst, out...), nil
+}
+
+func (s2Codec) MaxEncodedLen(n int) int { return s2.MaxEncodedLen(n) }
+
+func (s2Codec) Decode(dst, src []byte, size int) ([]byte, error) {
+	n, err := s2.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("s2: block declares %d bytes, want %d", n, size)
+	}
+	start := len(dst)
+	if cap(dst)-start < size {
+		dst = append(make([]byte, 0, start+size), dst...)
+	}
+	out, err := s2.Decode(dst[start:start+size], src)
 	if err != nil {
-		decompressBufPool.Put(decompressed[:0]) // Return to pool on error
 		return nil, err
 	}
-	// Note: Buffer is not returned to pool since caller uses it
-	// This is a tradeoff - we get reduced initial allocation but don't fully reuse
-	return decompressed, nil
+	return dst[:start+len(out)], nil
 }
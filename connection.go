@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -11,19 +14,29 @@ const (
 	ioTimeout       = 5 * time.Minute  // generous for large blocks on slow links
 	keepAlivePeriod = 30 * time.Second
 	maxRetries      = 3
+	rateChunk       = 256 * 1024 // write size when rate limited
 )
 
 // connWrite writes all bytes to conn, retrying on partial writes.
 // Sets a per-iteration write deadline to detect stalled peers.
+// When a network limit is set, data is written in rateChunk pieces.
 func connWrite(conn net.Conn, data []byte) error {
 	var start, c int
 	var err error
 	for {
+		end := len(data)
+		if netLimiter.Enabled() {
+			if end-start > rateChunk {
+				end = start + rateChunk
+			}
+			netLimiter.Wait(end - start)
+		}
 		conn.SetWriteDeadline(time.Now().Add(ioTimeout))
-		if c, err = conn.Write(data[start:]); err != nil {
+		if c, err = conn.Write(data[start:end]); err != nil {
 			return err
 		}
 		start += c
+		metricAdd(&metrics.bytesSent, uint64(c))
 		if start == len(data) {
 			break
 		}
@@ -34,28 +47,142 @@ func connWrite(conn net.Conn, data []byte) error {
 	return nil
 }
 
+// endpoint is the server a client connects to, resolved once from -r
+type endpoint struct {
+	name string
+	dial func() (net.Conn, error)
+	pipe bool // stdin/stdout (-r -): a single stream, never redialed
+
+	// Multi-path workers: failed reports a broken connection, moved tells
+	// that the worker was given another path
+	failed func(err error)
+	moved  func() bool
+}
+
+// resolveEndpoint resolves the server address given with -r: host:port,
+// unix:/path, vsock:cid:port or - for the pipe
+func resolveEndpoint(address string) (*endpoint, error) {
+	return resolveEndpointFrom(address, "")
+}
+
+// resolveEndpointFrom resolves a TCP server address dialed from the local
+// IP bind (none: any), or any other address without one
+func resolveEndpointFrom(address, bind string) (*endpoint, error) {
+	dialer := net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlivePeriod}
+	if bind != "" {
+		ip := net.ParseIP(strings.Trim(bind, "[]"))
+		if ip == nil {
+			return nil, fmt.Errorf("local address %q is not an IP", bind)
+		}
+		if address == pipeAddr || isLocalAddr(address) {
+			return nil, fmt.Errorf("local address %s given for %s", bind, address)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	if address == pipeAddr {
+		return pipeEndpoint(), nil
+	}
+	if isLocalAddr(address) {
+		dial, err := dialLocal(address)
+		if err != nil {
+			return nil, err
+		}
+		return &endpoint{name: address, dial: dial}, nil
+	}
+
+	// A hostname is resolved once; every address is tried in turn
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{address}
+	if host != "" {
+		ips, err := resolveHost(host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = addrs[:0]
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+		Debug("%s resolves to %v\n", host, addrs)
+	}
+	return &endpoint{
+		name: address,
+		dial: func() (net.Conn, error) {
+			var err error
+			for _, a := range addrs {
+				var c net.Conn
+				if c, err = dialer.Dial("tcp", a); err == nil {
+					return c, nil
+				}
+				Debug("connecting to %s: %s\n", a, err)
+			}
+			return nil, err
+		},
+	}, nil
+}
+
+// ipFamily is -ip-family: auto keeps the resolver's order (RFC 6724),
+// 4 or 6 moves that family's addresses first
+var ipFamily = "auto"
+
+func setIPFamily(s string) {
+	switch s {
+	case "auto", "4", "6":
+		ipFamily = s
+	default:
+		Err("unknown -ip-family: %s (use auto, 4 or 6)\n", s)
+	}
+}
+
+// resolveHost looks up host, ordered by -ip-family; an IP is used as is
+func resolveHost(host string) ([]net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return sortFamily(ips, ipFamily), nil
+}
+
+// sortFamily moves the addresses of family first, keeping the order within each
+func sortFamily(ips []net.IPAddr, family string) []net.IPAddr {
+	if family == "auto" {
+		return ips
+	}
+	first := func(ip net.IPAddr) bool { return (ip.IP.To4() != nil) == (family == "4") }
+	sort.SliceStable(ips, func(i, j int) bool { return first(ips[i]) && !first(ips[j]) })
+	return ips
+}
+
 type AutoReconnectTCP struct {
-	addr *net.TCPAddr
-	conn *net.TCPConn
+	ep     *endpoint
+	conn   net.Conn
+	dialed bool // a connection was established before; next dial is a reconnect
 }
 
-func NewAutoReconnectTCP(addr *net.TCPAddr) *AutoReconnectTCP {
-	return &AutoReconnectTCP{addr: addr}
+func NewAutoReconnectTCP(ep *endpoint) *AutoReconnectTCP {
+	return &AutoReconnectTCP{ep: ep}
 }
 
 func (a *AutoReconnectTCP) connect() error {
 	if a.conn != nil {
 		return nil
 	}
-	Log("connecting to %s ..\n", a.addr)
+	Log("connecting to %s ..\n", a.ep.name)
+	if a.dialed {
+		metricAdd(&metrics.reconnects, 1)
+	}
 
-	c, err := net.DialTimeout("tcp", a.addr.String(), dialTimeout)
+	c, err := a.ep.dial()
 	if err != nil {
 		return err
 	}
-	a.conn = c.(*net.TCPConn)
-	a.conn.SetKeepAlive(true)
-	a.conn.SetKeepAlivePeriod(keepAlivePeriod)
+	a.dialed = true
+	a.conn = c // TCP keep-alive is set by the dialer
 	return nil
 }
 
@@ -63,8 +190,24 @@ func (a *AutoReconnectTCP) connect() error {
 // Read/Write call triggers a reconnect.
 func (a *AutoReconnectTCP) handleErr(err error) {
 	if a.conn != nil {
+		if p, ok := a.conn.(*pipeConn); ok {
+			p.fail(err) // out of step, the next dial gives up
+		}
+		if a.ep.failed != nil {
+			a.ep.failed(err)
+		}
+		a.conn.Close()
+		a.conn = nil
+	}
+}
+
+// Rebalance drops the connection between blocks when the worker was
+// moved to another path, so the next block dials it
+func (a *AutoReconnectTCP) Rebalance() {
+	if a.conn != nil && a.ep.moved != nil && a.ep.moved() {
 		a.conn.Close()
 		a.conn = nil
+		a.dialed = false // a move, not a reconnect
 	}
 }
 
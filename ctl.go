@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// limitsFile (-limits-file) holds control commands, one per line, applied
+// at start and again on SIGUSR1
+var limitsFile string
+
+var (
+	ctlMu   sync.Mutex
+	ctlPath string // control socket to remove on exit, "" once removed
+)
+
+// startControlSocket listens on a unix socket for runtime commands:
+//
+//	bwlimit <rate>|auto   set network limit (auto = back to flag/schedule)
+//	iolimit <rate>|auto   set disk read limit
+//	status                print current limits
+func startControlSocket(path string) {
+	if err := removeStaleSocket(path); err != nil {
+		Err("control socket: %s\n", err.Error())
+		return
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		Err("control socket: %s\n", err.Error())
+		return
+	}
+	ctlMu.Lock()
+	ctlPath = path
+	ctlMu.Unlock()
+	// Commands change limits: only the owner may connect
+	if err := os.Chmod(path, 0600); err != nil {
+		Err("control socket: %s\n", err.Error())
+	}
+	Log("control socket listening on %s\n", path)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				Log("control socket: %s\n", err.Error())
+				return
+			}
+			go handleControlConn(conn)
+		}
+	}()
+}
+
+// removeControlSocket removes the control socket, on every way out
+func removeControlSocket() {
+	ctlMu.Lock()
+	defer ctlMu.Unlock()
+	if ctlPath != "" {
+		os.Remove(ctlPath)
+		ctlPath = ""
+	}
+}
+
+func handleControlConn(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fmt.Fprintf(conn, "%s\n", controlCommand(scanner.Text()))
+	}
+}
+
+// loadLimitsFile applies the commands of a limits file; blank lines and
+// '#' comments are skipped, the first failing command stops it
+func loadLimitsFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if reply := controlCommand(line); strings.HasPrefix(reply, "ERR") {
+			return fmt.Errorf("%s line %d: %s", path, i+1, strings.TrimPrefix(reply, "ERR "))
+		}
+	}
+	return nil
+}
+
+// controlCommand executes one command line and returns the reply
+func controlCommand(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "ERR empty command"
+	}
+
+	switch fields[0] {
+	case "status":
+		return fmt.Sprintf("OK bwlimit=%s iolimit=%s", formatRate(netLimiter.Rate()), formatRate(diskLimiter.Rate()))
+	case "bwlimit", "iolimit":
+		if len(fields) != 2 {
+			return "ERR usage: " + fields[0] + " <rate>|auto"
+		}
+		rl := netLimiter
+		if fields[0] == "iolimit" {
+			rl = diskLimiter
+		}
+		if fields[1] == "auto" {
+			rl.ResumeSchedule()
+		} else {
+			rate, err := parseRate(fields[1])
+			if err != nil {
+				return "ERR " + err.Error()
+			}
+			rl.SetManual(rate)
+		}
+		Log("%s limit set at runtime -> %s\n", rl.name, formatRate(rl.Rate()))
+		return "OK " + formatRate(rl.Rate())
+	}
+	return "ERR unknown command: " + fields[0]
+}
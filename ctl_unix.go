@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLimitsFile re-reads the limits file on SIGUSR1
+func watchLimitsFile(path string) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			Log("SIGUSR1: re-reading %s\n", path)
+			if err := loadLimitsFile(path); err != nil {
+				Error("limits file: %s\n", err.Error())
+			}
+		}
+	}()
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+// watchLimitsFile: Windows has no SIGUSR1, the file is only read at start;
+// use -ctl to change limits while running
+func watchLimitsFile(path string) {
+	Warn("limits file: %s is read once, SIGUSR1 is not available on Windows (use -ctl)\n", path)
+}
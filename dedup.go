@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Block reuse (-dedup, on by default): hash requests carry the source
+// block's hash. When the destination block differs but another destination
+// block already holds that content, the server copies it into place with a
+// reflink or copy_file_range and answers copiedHash, so the payload never
+// crosses the wire. Only blocks hashed or written so far are candidates.
+var dedupEnabled = true
+
+// reuseBlock fills block msg.BlockIdx from another local block with the
+// hash the client sent. The copy is read back and checked: the source
+// block may be rewritten by another connection at the same time.
+func reuseBlock(file *os.File, cache *ChecksumCache, msg *Msg, buf []byte) bool {
+	want := msg.Hash[:]
+	src, ok := cache.Find(want)
+	if !ok || src == msg.BlockIdx {
+		return false
+	}
+	if msg.DryRun {
+		return true
+	}
+
+	length := int64(blockLen(msg.BlockIdx, msg.BlockSize, msg.FileSize))
+	srcOff := int64(src) * int64(msg.BlockSize)
+	dstOff := int64(msg.BlockIdx) * int64(msg.BlockSize)
+
+	method, err := copyRange(file, srcOff, dstOff, length, buf)
+	if err != nil {
+		Debug("\t- reuse of block %d for %d failed: %s\n", src, msg.BlockIdx, err)
+	}
+	if cacheMode != "normal" {
+		dropCache(file, dstOff, length, true)
+	}
+
+	// A failed copy may have changed part of the block, so the cache is
+	// updated from what is on disk either way
+	n, rerr := readAt(file, buf[:length], dstOff)
+	if rerr != nil && rerr != io.EOF {
+		Debug("\t- reading back block %d: %s\n", msg.BlockIdx, rerr)
+		return false
+	}
+	got := checksum(buf[:n])
+	if isZeroBlock(buf[:n]) {
+		got = zeroBlockHash
+	}
+	if !bytes.Equal(got, want) {
+		cache.Set(msg.BlockIdx, got)
+		if err == nil {
+			Debug("\t- block %d copied from %d does not match, block %d changed meanwhile\n", msg.BlockIdx, src, src)
+		}
+		return false
+	}
+	if err := syncWritten(file); err != nil {
+		Error("\t- sync failed: %s\n", err.Error())
+		return false
+	}
+
+	cache.Set(msg.BlockIdx, got)
+	Debug("\t- block %d reused from block %d (%s)\n", msg.BlockIdx, src, method)
+	return true
+}
+
+// copyWithin copies length bytes inside file from src to dst through buf
+func copyWithin(file *os.File, src, dst, length int64, buf []byte) error {
+	n, err := readAt(file, buf[:length], src)
+	if int64(n) < length {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	_, err = writeAt(file, buf[:length], dst)
+	return err
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyRange copies length bytes inside file from src to dst: a reflink of
+// the range when the filesystem and alignment allow it, else copy_file_range,
+// else through buf
+func copyRange(file *os.File, src, dst, length int64, buf []byte) (string, error) {
+	fd := int(file.Fd())
+	err := unix.IoctlFileCloneRange(fd, &unix.FileCloneRange{
+		Src_fd:      int64(fd),
+		Src_offset:  uint64(src),
+		Src_length:  uint64(length),
+		Dest_offset: uint64(dst),
+	})
+	if err == nil {
+		return "reflink", nil
+	}
+
+	var copied int64
+	for copied < length {
+		in, out := src+copied, dst+copied
+		n, err := unix.CopyFileRange(fd, &in, fd, &out, int(length-copied), 0)
+		if err != nil || n == 0 {
+			if copied == 0 {
+				return "copy", copyWithin(file, src, dst, length, buf)
+			}
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		copied += int64(n)
+	}
+	return "copy_file_range", nil
+}
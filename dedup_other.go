@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+func copyRange(file *os.File, src, dst, length int64, buf []byte) (string, error) {
+	return "copy", copyWithin(file, src, dst, length, buf)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Trained zstd dictionaries (-dict): every block is compressed on its own,
+// so with small blocks zstd has little history to find matches in. The
+// client trains a dictionary on blocks sampled across the source, ships it
+// once on its own connection before the transfer workers connect, and both
+// sides load it into their zstd pools. Frames record the dictionary id, so
+// blocks compressed without it still decode.
+const (
+	dictMaxSize     = 64 * 1024
+	dictSamples     = 256             // blocks sampled across the source
+	dictSampleBytes = 2 * 1024 * 1024 // read for training, at most
+	dictMinSamples  = 8               // fewer non-zero samples: no dictionary
+	dictMaxPayload  = 1024 * 1024     // largest dictionary a server accepts
+)
+
+var dictTrain bool
+
+// setDictionary replaces the zstd pools with ones loading d, nil removes
+// it. Blocks in flight finish with the pools they started with.
+func setDictionary(d []byte) error {
+	if d != nil {
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(d))
+		if err != nil {
+			return err
+		}
+		dec.Close()
+	}
+	zstdState.Store(newZstdPools(d))
+	return nil
+}
+
+// trainDictionary builds a dictionary from up to dictSamples blocks spread
+// evenly over the source, reading at most dictSampleBytes
+func trainDictionary(file *os.File, blockSize uint32, fileSize uint64) ([]byte, error) {
+	blocks := uint32((fileSize-1)/uint64(blockSize)) + 1
+	count := uint32(dictSamples)
+	if blocks < count {
+		count = blocks
+	}
+	sampleLen := uint64(dictSampleBytes / count)
+	if sampleLen > uint64(blockSize) {
+		sampleLen = uint64(blockSize)
+	}
+
+	buf := bufPool.Get(int(blockSize))
+	defer bufPool.Put(buf)
+	var samples [][]byte
+	for i := uint32(0); i < count; i++ {
+		idx := uint32(uint64(i) * uint64(blocks) / uint64(count))
+		n := blockLen(idx, blockSize, fileSize)
+		got, err := readAt(file, buf[:n], int64(idx)*int64(blockSize))
+		if err != nil && err != io.EOF {
+			Debug("dictionary: skipping block %d: %s\n", idx, err)
+			continue
+		}
+		sample := buf[:got]
+		if uint64(len(sample)) > sampleLen {
+			sample = sample[:sampleLen]
+		}
+		if len(sample) == 0 || isZeroBlock(sample) {
+			continue
+		}
+		samples = append(samples, append([]byte(nil), sample...))
+	}
+	if len(samples) < dictMinSamples {
+		return nil, fmt.Errorf("only %d non-zero samples", len(samples))
+	}
+
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: dictMaxSize,
+		HashBytes:   6,
+		ZstdLevel:   zstdLevels[compLevelCur],
+	})
+}
+
+// setupDictionary trains the dictionary and hands it to the server; on any
+// failure the transfer goes on without one
+func setupDictionary(ep *endpoint, file *os.File, blockSize uint32, fileSize uint64) {
+	if !dictTrain {
+		return
+	}
+	start := time.Now()
+	d, err := trainDictionary(file, blockSize, fileSize)
+	if err != nil {
+		Warn("dictionary: training failed, compressing without one: %s\n", err)
+		return
+	}
+	Log("dictionary: trained %d bytes in %s\n", len(d), time.Since(start).Round(time.Millisecond))
+
+	conn := NewAutoReconnectTCP(ep)
+	defer conn.Close()
+	if err := sendDictionary(conn, d, blockSize, fileSize); err != nil {
+		Warn("dictionary: not accepted by the server, compressing without one: %s\n", err)
+		return
+	}
+	if err := setDictionary(d); err != nil {
+		Err("dictionary: %s\n", err)
+	}
+}
+
+// sendDictionary ships the dictionary and waits until the server loaded it
+func sendDictionary(conn *AutoReconnectTCP, d []byte, blockSize uint32, fileSize uint64) error {
+	payload := d
+	if IsEncryptionEnabled() {
+		payload = encryptBlock(d)
+	}
+	msg, err := pack(&Msg{
+		MagicHead: stringToFixedSizeArray(magicHead),
+		BlockSize: blockSize,
+		FileSize:  fileSize,
+		DataSize:  uint32(len(payload)),
+		DryRun:    dryRun,
+		Dict:      true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := connWrite(conn, msg); err != nil {
+		return err
+	}
+	if err := connWrite(conn, payload); err != nil {
+		return err
+	}
+
+	ack := make([]byte, len(dictAckHash))
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return err
+	}
+	if bytes.Equal(ack, refusedHash) {
+		Err("server refused the transfer (destination size policy), see the server log\n")
+	}
+	if !bytes.Equal(ack, dictAckHash) {
+		return fmt.Errorf("unexpected reply %x", ack)
+	}
+	return nil
+}
+
+// receiveDictionary reads a dictionary sent by the client, loads it and
+// acknowledges it
+func receiveDictionary(r io.Reader, conn net.Conn, size uint32) error {
+	if size > dictMaxPayload {
+		return fmt.Errorf("dictionary of %d bytes is too large", size)
+	}
+	d := make([]byte, size)
+	if _, err := io.ReadFull(r, d); err != nil {
+		return err
+	}
+	metricAdd(&metrics.bytesReceived, uint64(size))
+	if IsEncryptionEnabled() {
+		var err error
+		if d, err = decryptBlock(d); err != nil {
+			return err
+		}
+	}
+	if len(d) == 0 {
+		return errors.New("empty dictionary")
+	}
+	if err := setDictionary(d); err != nil {
+		return err
+	}
+	Log("dictionary: loaded %d bytes from the client\n", len(d))
+	return connWrite(conn, dictAckHash)
+}
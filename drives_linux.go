@@ -0,0 +1,211 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// driveInfo describes a block device or partition for -a
+type driveInfo struct {
+	Name        string      `json:"name"`
+	Path        string      `json:"path"`
+	Dev         string      `json:"dev"`
+	Size        uint64      `json:"size"`
+	Model       string      `json:"model,omitempty"`
+	Rotational  bool        `json:"rotational"`
+	Removable   bool        `json:"removable"`
+	ReadOnly    bool        `json:"read_only"`
+	FSType      string      `json:"fstype,omitempty"`
+	Label       string      `json:"label,omitempty"`
+	UUID        string      `json:"uuid,omitempty"`
+	Mountpoints []string    `json:"mountpoints,omitempty"`
+	Holders     []string    `json:"holders,omitempty"`
+	InUse       string      `json:"in_use,omitempty"` // why bsync would refuse to write it
+	Partitions  []driveInfo `json:"partitions,omitempty"`
+}
+
+func listDrives(format string) {
+	drives := scanDrives()
+
+	if format == "json" {
+		out, _ := json.MarshalIndent(drives, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	fmt.Println("Block devices (use with -f):")
+	if len(drives) == 0 {
+		fmt.Println("  (none found)")
+		return
+	}
+	for _, d := range drives {
+		printDrive(d, "  ")
+		for _, p := range d.Partitions {
+			printDrive(p, "    ")
+		}
+	}
+}
+
+func printDrive(d driveInfo, indent string) {
+	kind := "ssd"
+	if d.Rotational {
+		kind = "hdd"
+	}
+	var details []string
+	if d.Model != "" {
+		details = append(details, d.Model)
+	}
+	if d.Removable {
+		details = append(details, "removable")
+	}
+	if d.ReadOnly {
+		details = append(details, "read-only")
+	}
+	if d.FSType != "" {
+		details = append(details, d.FSType)
+	}
+	if d.Label != "" {
+		details = append(details, "label="+d.Label)
+	}
+	if d.UUID != "" {
+		details = append(details, "uuid="+d.UUID)
+	}
+	if len(d.Mountpoints) > 0 {
+		details = append(details, "on "+strings.Join(d.Mountpoints, ","))
+	}
+	if len(d.Holders) > 0 {
+		details = append(details, "held by "+strings.Join(d.Holders, ","))
+	}
+	if d.InUse != "" && len(d.Mountpoints) == 0 && len(d.Holders) == 0 {
+		details = append(details, d.InUse)
+	}
+
+	sizeGB := float64(d.Size) / (1024 * 1024 * 1024)
+	fmt.Printf("%s-f %-20s  %8.2f GB  [%s]  %s\n", indent, d.Path, sizeGB, kind, strings.Join(details, ", "))
+}
+
+// scanDrives reads /sys/block, skipping empty devices (unbound loop, ram)
+func scanDrives() []driveInfo {
+	var mounts map[string][]string
+	if f, err := os.Open("/proc/self/mountinfo"); err == nil {
+		mounts, _ = parseMountinfo(f)
+		f.Close()
+	}
+
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil
+	}
+
+	var drives []driveInfo
+	for _, e := range entries {
+		dir := filepath.Join("/sys/block", e.Name())
+		d := readBlockInfo(dir, mounts)
+		if d.Size == 0 {
+			continue
+		}
+		d.Model = sysfsString(filepath.Join(dir, "device", "model"))
+		d.Rotational = sysfsString(filepath.Join(dir, "queue", "rotational")) == "1"
+		d.Removable = sysfsString(filepath.Join(dir, "removable")) == "1"
+
+		parts, _ := os.ReadDir(dir)
+		for _, p := range parts {
+			pdir := filepath.Join(dir, p.Name())
+			if _, err := os.Stat(filepath.Join(pdir, "partition")); err != nil {
+				continue
+			}
+			part := readBlockInfo(pdir, mounts)
+			part.Rotational = d.Rotational
+			part.Removable = d.Removable
+			part.InUse, _ = deviceInUse(part.Path)
+			d.Partitions = append(d.Partitions, part)
+		}
+		// sda10 sorts before sda2 by name, the minor number keeps disk order
+		sort.Slice(d.Partitions, func(i, j int) bool {
+			return devMinor(d.Partitions[i].Dev) < devMinor(d.Partitions[j].Dev)
+		})
+
+		d.InUse, _ = deviceInUse(d.Path)
+		drives = append(drives, d)
+	}
+	return drives
+}
+
+// readBlockInfo fills the fields shared by disks and partitions
+func readBlockInfo(dir string, mounts map[string][]string) driveInfo {
+	name := filepath.Base(dir)
+	d := driveInfo{
+		Name: name,
+		Path: "/dev/" + name,
+		Dev:  sysfsString(filepath.Join(dir, "dev")),
+	}
+	if sectors, err := strconv.ParseUint(sysfsString(filepath.Join(dir, "size")), 10, 64); err == nil {
+		d.Size = sectors * 512 // sysfs counts 512-byte sectors regardless of the device
+	}
+	d.ReadOnly = sysfsString(filepath.Join(dir, "ro")) == "1"
+	d.Mountpoints = mounts[d.Dev]
+
+	holders, _ := os.ReadDir(filepath.Join(dir, "holders"))
+	for _, h := range holders {
+		holder := h.Name()
+		if dmName := sysfsString(filepath.Join("/sys/class/block", holder, "dm", "name")); dmName != "" {
+			holder += " (" + dmName + ")"
+		}
+		d.Holders = append(d.Holders, holder)
+	}
+
+	d.FSType, d.Label, d.UUID = filesystemInfo(d.Dev, name)
+	return d
+}
+
+func devMinor(dev string) int {
+	minor, _ := strconv.Atoi(dev[strings.Index(dev, ":")+1:])
+	return minor
+}
+
+// filesystemInfo returns type, label and UUID from the udev database, or the
+// label and UUID from /dev/disk/by-* links when udev data is not readable
+func filesystemInfo(dev, name string) (fstype, label, uuid string) {
+	if data, err := os.ReadFile("/run/udev/data/b" + dev); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			switch {
+			case strings.HasPrefix(line, "E:ID_FS_TYPE="):
+				fstype = strings.TrimPrefix(line, "E:ID_FS_TYPE=")
+			case strings.HasPrefix(line, "E:ID_FS_LABEL="):
+				label = strings.TrimPrefix(line, "E:ID_FS_LABEL=")
+			case strings.HasPrefix(line, "E:ID_FS_UUID="):
+				uuid = strings.TrimPrefix(line, "E:ID_FS_UUID=")
+			}
+		}
+		return fstype, label, uuid
+	}
+
+	return fstype, diskLinkFor("/dev/disk/by-label", name), diskLinkFor("/dev/disk/by-uuid", name)
+}
+
+// diskLinkFor returns the name of the link in dir pointing at /dev/<name>
+func diskLinkFor(dir, name string) string {
+	links, _ := os.ReadDir(dir)
+	for _, l := range links {
+		target, err := os.Readlink(filepath.Join(dir, l.Name()))
+		if err == nil && filepath.Base(target) == name {
+			return unescapeUdev(l.Name())
+		}
+	}
+	return ""
+}
+
+func sysfsString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -1,10 +1,9 @@
-//go:build !windows
+//go:build !windows && !linux
 
 package main
 
 import "fmt"
 
-func listDrives() {
-	fmt.Println("Drive listing (-a) is Windows-only.")
-	fmt.Println("On Linux, use: lsblk")
+func listDrives(format string) {
+	fmt.Println("Drive listing (-a) is only available on Linux and Windows.")
 }
@@ -88,7 +88,11 @@ func queryPhysicalDriveSize(path string) (int64, uint32, error) {
 	return geom.DiskSize, uint32(geom.Geometry.BytesPerSector), nil
 }
 
-func listDrives() {
+func listDrives(format string) {
+	if format == "json" {
+		fmt.Println("JSON drive listing (-list-format json) is only available on Linux.")
+		return
+	}
 	fmt.Println("Physical drives (use with -f, requires Administrator):")
 	found := false
 	for i := 0; i < 16; i++ {
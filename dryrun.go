@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dry-run (-dry-run): hash and compare every block as usual, but never send
+// payloads or write. The client collects what would have been transferred.
+var (
+	dryRun   bool
+	dryState dryRunState
+)
+
+const (
+	dryRunProbeBytes = 64 * 1024 * 1024 // max payload sent to measure the link rate
+	dryRunProbeChunk = 4 * 1024 * 1024
+	dryRunProbeTime  = 2 * time.Second // probe stops sending after this long
+	dryRunMaxRanges  = 50              // ranges printed in the text report
+)
+
+type dryRunState struct {
+	mu           sync.Mutex
+	blocks       []uint32 // differing blocks
+	zeroBlocks   uint64   // differing blocks that would be zeroed
+	reusedBlocks uint64   // differing blocks the server would copy locally (-dedup)
+	estBytes     uint64   // bytes that would go over the wire
+	origBytes    uint64   // original size of differing data blocks
+	linkRate     float64  // bytes per second, 0 if not measured
+}
+
+// DryRunReport is printed at the end and included in the JSON report
+type DryRunReport struct {
+	DiffBlocks   int         `json:"diff_blocks"`
+	DiffRanges   [][2]uint32 `json:"diff_ranges"`
+	ZeroBlocks   uint64      `json:"zero_blocks"`
+	ReusedBlocks uint64      `json:"reused_blocks"`
+	EstBytes     uint64      `json:"estimated_bytes"`
+	OrigBytes    uint64      `json:"original_bytes"`
+	LinkRateMBs  float64     `json:"link_rate_mbs"`
+	EstDuration  float64     `json:"estimated_duration_sec"`
+}
+
+// dryRunRecord notes a block that differs from the destination
+func dryRunRecord(blockIdx uint32, zero bool, wireBytes, origBytes uint64) {
+	dryState.mu.Lock()
+	defer dryState.mu.Unlock()
+	dryState.blocks = append(dryState.blocks, blockIdx)
+	if zero {
+		dryState.zeroBlocks++
+		return
+	}
+	dryState.estBytes += wireBytes
+	dryState.origBytes += origBytes
+}
+
+// dryRunReused notes a differing block the server would copy from its own data
+func dryRunReused(blockIdx uint32) {
+	dryState.mu.Lock()
+	defer dryState.mu.Unlock()
+	dryState.blocks = append(dryState.blocks, blockIdx)
+	dryState.reusedBlocks++
+}
+
+// blockRanges coalesces block indexes into sorted [first, last] ranges
+func blockRanges(blocks []uint32) [][2]uint32 {
+	sorted := append([]uint32{}, blocks...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var ranges [][2]uint32
+	for _, idx := range sorted {
+		if n := len(ranges); n > 0 && ranges[n-1][1]+1 == idx {
+			ranges[n-1][1] = idx
+			continue
+		}
+		ranges = append(ranges, [2]uint32{idx, idx})
+	}
+	return ranges
+}
+
+// dryRunProbe measures the link rate by sending random payloads the server
+// discards (Msg.DryRun), finished by a hash round trip so the time includes
+// the server draining them.
+func dryRunProbe(conn *AutoReconnectTCP, blockSize uint32, fileSize uint64) error {
+	magicBytes := stringToFixedSizeArray(magicHead)
+
+	chunk := blockSize
+	if chunk > dryRunProbeChunk {
+		chunk = dryRunProbeChunk
+	}
+	payload := make([]byte, chunk)
+	rand.Read(payload)
+
+	hdr, err := pack(&Msg{
+		MagicHead: magicBytes,
+		BlockSize: blockSize,
+		FileSize:  fileSize,
+		DataSize:  chunk,
+		DryRun:    true,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := pack(&Msg{
+		MagicHead: magicBytes,
+		BlockSize: blockSize,
+		FileSize:  fileSize,
+		DryRun:    true,
+	})
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var sent uint64
+	for sent < dryRunProbeBytes && time.Since(start) < dryRunProbeTime {
+		if err := connWrite(conn, hdr); err != nil {
+			return err
+		}
+		if err := connWrite(conn, payload); err != nil {
+			return err
+		}
+		sent += uint64(chunk)
+	}
+	if err := connWrite(conn, req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(zeroBlockHash))); err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start).Seconds()
+	if elapsed > 0 {
+		dryState.mu.Lock()
+		dryState.linkRate = float64(sent) / elapsed
+		dryState.mu.Unlock()
+	}
+	return nil
+}
+
+// dryRunResult builds the report from the collected state
+func dryRunResult() *DryRunReport {
+	dryState.mu.Lock()
+	defer dryState.mu.Unlock()
+
+	r := &DryRunReport{
+		DiffBlocks:   len(dryState.blocks),
+		DiffRanges:   blockRanges(dryState.blocks),
+		ZeroBlocks:   dryState.zeroBlocks,
+		ReusedBlocks: dryState.reusedBlocks,
+		EstBytes:     dryState.estBytes,
+		OrigBytes:    dryState.origBytes,
+		LinkRateMBs:  dryState.linkRate / mb1,
+	}
+	if dryState.linkRate > 0 {
+		r.EstDuration = float64(dryState.estBytes) / dryState.linkRate
+	}
+	return r
+}
+
+// printDryRunReport logs the human-readable summary
+func printDryRunReport(r *DryRunReport, totalBlocks uint32) {
+	Log("dry-run: %d of %d blocks differ, %d of them zero blocks, %d found elsewhere on the destination\n",
+		r.DiffBlocks, totalBlocks, r.ZeroBlocks, r.ReusedBlocks)
+
+	var parts []string
+	for i, rg := range r.DiffRanges {
+		if i == dryRunMaxRanges {
+			parts = append(parts, fmt.Sprintf("... (%d more)", len(r.DiffRanges)-i))
+			break
+		}
+		if rg[0] == rg[1] {
+			parts = append(parts, fmt.Sprintf("%d", rg[0]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", rg[0], rg[1]))
+		}
+	}
+	if len(parts) > 0 {
+		Log("dry-run: differing blocks: %s\n", strings.Join(parts, ","))
+	}
+
+	Log("dry-run: would send %d bytes (%d bytes before compression)\n", r.EstBytes, r.OrigBytes)
+	if r.LinkRateMBs > 0 {
+		Log("dry-run: measured link rate %0.2f MB/s, estimated duration %s\n",
+			r.LinkRateMBs, time.Duration(r.EstDuration*float64(time.Second)).Round(time.Second))
+	} else {
+		Warn("dry-run: link rate not measured, no duration estimate\n")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Durability policy (-fsync) for the destination:
+// none  - leave flushing to the OS
+// end   - sync once after the last block, before DONE is acknowledged
+// N     - also sync after every N written blocks
+// block - sync every block before the connection's next request is answered
+var (
+	fsyncPolicy = "end"
+	fsyncEvery  uint64 // blocks between syncs, 0 for none/end
+	fsyncWrites uint64 // atomic - blocks written
+	fsyncCount  uint64 // atomic - syncs done
+	fsyncNanos  uint64 // atomic - time spent syncing
+)
+
+func setFsyncPolicy(policy string) {
+	switch policy {
+	case "none", "end":
+	case "block":
+		fsyncEvery = 1
+	default:
+		n, err := strconv.ParseUint(policy, 10, 32)
+		if err != nil || n == 0 {
+			Err("unknown fsync policy: %s (use none, end, block or a block count)\n", policy)
+		}
+		fsyncEvery = n
+	}
+	fsyncPolicy = policy
+}
+
+// syncWritten is called after each block written to file
+func syncWritten(file *os.File) error {
+	if fsyncEvery == 0 {
+		return nil
+	}
+	if atomic.AddUint64(&fsyncWrites, 1)%fsyncEvery != 0 {
+		return nil
+	}
+	return syncFile(file)
+}
+
+// syncFile flushes written data to stable storage, unless -fsync none
+func syncFile(file *os.File) error {
+	if fsyncPolicy == "none" {
+		return nil
+	}
+	start := time.Now()
+	err := syncData(file)
+	atomic.AddUint64(&fsyncCount, 1)
+	atomic.AddUint64(&fsyncNanos, uint64(time.Since(start)))
+	return err
+}
+
+// logSyncStats reports the syncs done for the -fsync policy
+func logSyncStats() {
+	if count, d := fsyncStats(); count > 0 {
+		Log("fsync (%s): %d syncs, %s\n", fsyncPolicy, count, d.Round(time.Millisecond))
+	}
+}
+
+// fsyncStats returns the number of syncs and the total time they took
+func fsyncStats() (uint64, time.Duration) {
+	return atomic.LoadUint64(&fsyncCount), time.Duration(atomic.LoadUint64(&fsyncNanos))
+}
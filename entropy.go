@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Incompressible block detection (-entropy, on by default): before a block
+// is compressed, the byte entropy of a sample is estimated; encrypted or
+// already compressed data is close to 8 bits per byte and is sent raw
+// without a compression pass. After a run of such blocks the check itself
+// is skipped for the blocks that follow (the region estimate), for a window
+// that doubles while the data stays incompressible. Every regionProbe-th
+// block in the window is still checked, and one that compresses ends it.
+const (
+	entropyPiece  = 4096
+	entropyPieces = 4   // spread over the block
+	entropyLimit  = 7.9 // bits per byte, above this the block is not compressed
+	regionStreak  = 4   // incompressible blocks in a row before skipping checks
+	regionSkipMin = 8   // blocks
+	regionSkipMax = 256 // blocks
+	regionProbe   = 8   // check one block in this many inside a window
+)
+
+var entropyCheck = true
+
+var region struct {
+	mu        sync.Mutex
+	streak    int
+	skipFrom  uint32 // blocks in [skipFrom, skipUntil) are assumed incompressible
+	skipUntil uint32
+	backoff   uint32
+}
+
+// Compression counters, updated atomically
+var compStats struct {
+	nanos          uint64 // time spent compressing
+	bytes          uint64 // input bytes compressed
+	skippedEntropy uint64 // blocks sent raw after the entropy check
+	skippedRegion  uint64 // blocks sent raw by the region estimate, unchecked
+	skippedBytes   uint64
+}
+
+// compressRecord notes time spent compressing, used to price skipped blocks
+func compressRecord(n int, d time.Duration) {
+	atomic.AddUint64(&compStats.bytes, uint64(n))
+	atomic.AddUint64(&compStats.nanos, uint64(d))
+}
+
+// worthCompressing decides whether block idx is compressed at all
+func worthCompressing(idx uint32, data []byte) bool {
+	if !entropyCheck || activeCodec == codecNone {
+		return true
+	}
+
+	region.mu.Lock()
+	skip := idx >= region.skipFrom && idx < region.skipUntil && (idx-region.skipFrom+1)%regionProbe != 0
+	region.mu.Unlock()
+	if skip {
+		compressSkipped(&compStats.skippedRegion, len(data))
+		return false
+	}
+
+	if sampleEntropy(data) < entropyLimit {
+		region.mu.Lock()
+		region.streak = 0
+		region.backoff = regionSkipMin
+		region.skipUntil = 0
+		region.mu.Unlock()
+		return true
+	}
+
+	region.mu.Lock()
+	region.streak++
+	if region.streak >= regionStreak {
+		if region.backoff == 0 {
+			region.backoff = regionSkipMin
+		}
+		region.skipFrom = idx + 1
+		region.skipUntil = idx + 1 + region.backoff
+		Debug("compression: blocks %d-%d look incompressible, not checking them\n", region.skipFrom, region.skipUntil-1)
+		region.backoff *= 2
+		if region.backoff > regionSkipMax {
+			region.backoff = regionSkipMax
+		}
+	}
+	region.mu.Unlock()
+
+	compressSkipped(&compStats.skippedEntropy, len(data))
+	return false
+}
+
+func compressSkipped(counter *uint64, n int) {
+	atomic.AddUint64(counter, 1)
+	atomic.AddUint64(&compStats.skippedBytes, uint64(n))
+	if compAdaptive {
+		adaptSkipped(n)
+	}
+}
+
+// sampleEntropy returns the Shannon entropy in bits per byte of a few
+// pieces spread over data
+func sampleEntropy(data []byte) float64 {
+	var hist [256]int
+	total := 0
+	count := func(piece []byte) {
+		for _, b := range piece {
+			hist[b]++
+		}
+		total += len(piece)
+	}
+
+	if len(data) <= entropyPiece*entropyPieces {
+		count(data)
+	} else {
+		step := (len(data) - entropyPiece) / (entropyPieces - 1)
+		for i := 0; i < entropyPieces; i++ {
+			count(data[i*step : i*step+entropyPiece])
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+
+	var bits float64
+	for _, n := range hist {
+		if n > 0 {
+			p := float64(n) / float64(total)
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits
+}
+
+// compressSavings returns blocks sent raw without compressing and the CPU
+// time that saved, priced at the average compression speed of this run
+func compressSavings() (blocks uint64, saved time.Duration) {
+	blocks = atomic.LoadUint64(&compStats.skippedEntropy) + atomic.LoadUint64(&compStats.skippedRegion)
+	if n := atomic.LoadUint64(&compStats.bytes); n > 0 {
+		perByte := float64(atomic.LoadUint64(&compStats.nanos)) / float64(n)
+		saved = time.Duration(perByte * float64(atomic.LoadUint64(&compStats.skippedBytes)))
+	}
+	return blocks, saved
+}
+
+// logCompressSavings logs the entropy check summary
+func logCompressSavings() {
+	blocks, saved := compressSavings()
+	if blocks == 0 {
+		return
+	}
+	Log("compression: %d incompressible blocks sent without compressing (%d checked, %d by region estimate), ~%s CPU saved\n",
+		blocks, atomic.LoadUint64(&compStats.skippedEntropy), atomic.LoadUint64(&compStats.skippedRegion),
+		saved.Round(time.Millisecond))
+}
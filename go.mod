@@ -3,7 +3,8 @@ module bsync
 go 1.25.0
 
 require (
-	github.com/klauspost/compress v1.17.11 // indirect
-	golang.org/x/crypto v0.49.0 // indirect
-	golang.org/x/sys v0.42.0 // indirect
+	github.com/klauspost/compress v1.17.11
+	github.com/pierrec/lz4/v4 v4.1.22
+	golang.org/x/crypto v0.49.0
+	golang.org/x/sys v0.42.0
 )
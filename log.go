@@ -1,15 +1,58 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// Log levels, from least to most verbose
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+	levelTrace
+)
+
+var levelNames = []string{"ERROR", "WARN", "INFO", "DEBUG", "TRACE"}
+
 var logPrefix = "[main]"
 var quiet = false
 
+// Log output: stderr (or -log-file), leaving stdout for READY and progress
+var (
+	logLevelCur = levelInfo
+	logJSON     = false
+	logSession  string
+	logOut      io.Writer = os.Stderr
+	logFile     *os.File
+	logFilePath string
+	logMu       sync.Mutex
+)
+
+// Logger adds structured fields (i.e. worker=2) to every line
+type Logger struct {
+	fields []logField
+}
+
+type logField struct {
+	key string
+	val interface{}
+}
+
+var rootLog = &Logger{}
+
 func SetLog(pre1, pre2 string, q bool) {
 	quiet = q
 	if pre1 != "" {
@@ -19,20 +62,188 @@ func SetLog(pre1, pre2 string, q bool) {
 	}
 }
 
-func Log(format string, args ...interface{}) {
-	if quiet && !strings.Contains(format, "READY") {
+// SetupLogging applies -log-level, -log-format, -log-file and -session
+func SetupLogging(level, format, path, session string) {
+	lvl, ok := parseLogLevel(level)
+	if !ok {
+		Err("unknown log level: %s (use error, warn, info, debug, trace)\n", level)
+	}
+	logLevelCur = lvl
+
+	switch format {
+	case "text":
+	case "json":
+		logJSON = true
+	default:
+		Err("unknown log format: %s (use text or json)\n", format)
+	}
+
+	logSession = session
+	if logSession == "" {
+		buf := make([]byte, 4)
+		rand.Read(buf)
+		logSession = hex.EncodeToString(buf)
+	}
+
+	if path != "" {
+		logFilePath = path
+		if err := reopenLogFile(); err != nil {
+			Err("opening log file: %s\n", err.Error())
+		}
+		// Reopen on SIGHUP so logrotate can move the file away
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reopenLogFile(); err != nil {
+					Error("reopening log file: %s\n", err.Error())
+				}
+			}
+		}()
+	}
+}
+
+func parseLogLevel(s string) (logLevel, bool) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), true
+		}
+	}
+	return levelInfo, false
+}
+
+func reopenLogFile() error {
+	f, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	logMu.Lock()
+	old := logFile
+	logFile = f
+	logOut = f
+	logMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// With returns a logger that adds key=val to every line
+func (l *Logger) With(key string, val interface{}) *Logger {
+	fields := append(append([]logField{}, l.fields...), logField{key, val})
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Log(format string, args ...interface{})   { l.output(levelInfo, format, args...) }
+func (l *Logger) Warn(format string, args ...interface{})  { l.output(levelWarn, format, args...) }
+func (l *Logger) Error(format string, args ...interface{}) { l.output(levelError, format, args...) }
+func (l *Logger) Debug(format string, args ...interface{}) { l.output(levelDebug, format, args...) }
+func (l *Logger) Trace(format string, args ...interface{}) { l.output(levelTrace, format, args...) }
+
+func (l *Logger) output(level logLevel, format string, args ...interface{}) {
+	if level > logLevelCur || (quiet && level > levelError) {
 		return
 	}
 
-	ts := time.Now().Format("15:04:05")
+	now := time.Now()
 	msg := fmt.Sprintf(format, args...)
-	fmt.Printf("%s %s %s", ts, logPrefix, msg)
+
+	var line string
+	if logJSON {
+		entry := map[string]interface{}{
+			"time":    now.Format(time.RFC3339Nano),
+			"level":   strings.ToLower(levelNames[level]),
+			"prefix":  logPrefix,
+			"session": logSession,
+			"msg":     strings.TrimSpace(msg),
+		}
+		for _, f := range l.fields {
+			entry[f.key] = f.val
+		}
+		b, _ := json.Marshal(entry)
+		line = string(b) + "\n"
+	} else {
+		var sb strings.Builder
+		sb.WriteString(now.Format("2006-01-02 15:04:05.000"))
+		sb.WriteString(" " + logPrefix + " " + levelNames[level])
+		if logSession != "" {
+			sb.WriteString(" session=" + logSession)
+		}
+		for _, f := range l.fields {
+			fmt.Fprintf(&sb, " %s=%v", f.key, f.val)
+		}
+		sb.WriteString(" " + strings.Trim(msg, "\r\n") + "\n")
+		line = sb.String()
+	}
+
+	logMu.Lock()
+	io.WriteString(logOut, line)
+	logMu.Unlock()
 }
 
-func Err(format string, args ...interface{}) {
+// Log prints an info line
+func Log(format string, args ...interface{}) { rootLog.output(levelInfo, format, args...) }
+
+// Warn prints a warning line
+func Warn(format string, args ...interface{}) { rootLog.output(levelWarn, format, args...) }
+
+// Error prints an error line without exiting
+func Error(format string, args ...interface{}) { rootLog.output(levelError, format, args...) }
+
+// Debug prints a line only with -log-level debug or trace
+func Debug(format string, args ...interface{}) { rootLog.output(levelDebug, format, args...) }
+
+// Trace prints a line only with -log-level trace
+func Trace(format string, args ...interface{}) { rootLog.output(levelTrace, format, args...) }
+
+// Progress prints a human progress line to stdout (not to the log)
+func Progress(format string, args ...interface{}) {
+	if quiet {
+		return
+	}
 	ts := time.Now().Format("15:04:05")
 	msg := fmt.Sprintf(format, args...)
-	fmt.Printf("%s %s ERROR: %s", ts, logPrefix, msg)
-	os.Exit(1)
+	logMu.Lock()
+	fmt.Fprintf(os.Stdout, "%s %s %s", ts, logPrefix, msg)
+	logMu.Unlock()
+}
+
+// Ready prints the READY handshake line to stdout, which waitForReady
+// scans for when the server was spawned via -t. Printed even when quiet.
+func Ready(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logMu.Lock()
+	fmt.Fprintf(os.Stdout, "%s %s", logPrefix, msg)
+	logMu.Unlock()
+	Log(format, args...)
 }
 
+func Err(format string, args ...interface{}) {
+	rootLog.output(levelError, format, args...)
+	exitFatal(1, "error", strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+// exitFatal is the single way out on errors and signals: the final report,
+// then the cleanup main's deferred calls would have done
+func exitFatal(code int, status, msg string) {
+	finishProgress(status, code, msg)
+	abortAtomic()
+	removeControlSocket()
+	os.Exit(code)
+}
+
+// handleSignals makes SIGINT and SIGTERM take the fatal exit, with the usual
+// 128+signal status
+func handleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		Warn("%s, stopping\n", sig)
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		exitFatal(code, "interrupted", sig.String())
+	}()
+}
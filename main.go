@@ -2,11 +2,12 @@ package main
 
 import (
 	"flag"
+	"net"
 	"os"
 	"os/exec"
+	"time"
 )
 
-var debug bool = false
 var blockSize uint32 = 10485760
 var mb1 float64 = 1048576.0
 
@@ -26,17 +27,35 @@ func main() {
 	var encrypt bool
 	var encKeyReceived string
 	var compLevel string
+	var codecFlag string
 	var listAllDrives bool
+	var listFormat string
+	var ctlSocket string
+	var metricsAddr string
+	var logLevel string
+	var logFormat string
+	var logFilePath string
+	var session string
+	var progress string
+	var progressFd int
+	var progressFile string
 
 	flag.BoolVar(&listAllDrives, "a", false, "list available drives and partitions")
+	flag.StringVar(&listFormat, "list-format", "text", "drive list format for -a: text or json")
 	flag.StringVar(&device, "f", "/dev/zero", "specify file or device, i.e. '/dev/vda'")
-	flag.StringVar(&remoteAddr, "r", "", "specify remote address of server")
+	flag.StringVar(&remoteAddr, "r", "", "specify remote address of server: host:port, unix:/path, vsock:cid:port, or '-' for stdin/stdout; several comma-separated stripe the workers over them")
+	flag.StringVar(&localAddrs, "local-addr", "", "local IPs to connect from, one for all -r addresses or one per address (comma-separated)")
 	flag.UintVar(&bSize, "b", uint(blockSize), "block size, default 100M")
 	flag.UintVar(&skipIdx, "s", 0, "skip blocks, default 0")
-	flag.StringVar(&port, "p", "8080", "bind to port, default 8080")
-	flag.StringVar(&bindIp, "i", "0.0.0.0", "bind to IP, default 0.0.0.0")
+	flag.StringVar(&port, "p", "8080", "bind to port, default 8080; also unix:/path, vsock:cid:port, or '-' for stdin/stdout")
+	flag.StringVar(&socketMode, "socket-mode", "", "permissions of a unix: server socket, i.e. '0660' (default from the umask)")
+	flag.StringVar(&bindIp, "i", "0.0.0.0", "bind to IP, default 0.0.0.0 (all IPv4 and IPv6 addresses)")
+	flag.StringVar(&ipFamily, "ip-family", "auto", "address family tried first when a hostname resolves to both: auto, 4 or 6")
 	flag.BoolVar(&noCompress, "n", false, "do not compress blocks (by default compress)")
 	flag.StringVar(&compLevel, "L", "default", "compression level: fast, default, better, best")
+	flag.BoolVar(&entropyCheck, "entropy", true, "send blocks that look incompressible (byte entropy of a sample) without compressing them")
+	flag.StringVar(&codecFlag, "codec", "zstd", "compression codec: zstd, lz4 (fast LANs), s2 or none")
+	flag.BoolVar(&dictTrain, "dict", false, "train a zstd dictionary on sampled source blocks and send it to the server first (small -b)")
 	flag.StringVar(&sshTarget, "t", "", "launch remote server via ssh: user@host:/remote_path")
 	flag.StringVar(&logPrefix, "l", "", "custom log prefix")
 	flag.UintVar(&workers, "w", 1, "workers count, default 1")
@@ -45,22 +64,102 @@ func main() {
 	flag.BoolVar(&encrypt, "e", false, "enable encryption (auto-generates key)")
 	flag.StringVar(&encKeyReceived, "K", "", "encryption key (internal use)")
 	flag.BoolVar(&suppressProgress, "P", false, "suppress server progress output (set automatically when launched via -t)")
+	flag.StringVar(&bwLimit, "bwlimit", "", "network send limit in bytes/s, i.e. '50M' (default unlimited)")
+	flag.StringVar(&bwSchedule, "bwschedule", "", "network limit schedule, i.e. '08:00-18:00=10M,18:00-08:00=0'")
+	flag.StringVar(&ioLimit, "iolimit", "", "disk read limit in bytes/s, i.e. '100M' (default unlimited)")
+	flag.StringVar(&ioSchedule, "ioschedule", "", "disk read limit schedule, same format as -bwschedule")
+	flag.StringVar(&zeroMode, "zero", "auto", "how to zero destination blocks: auto, write, punch, discard, zeroout")
+	flag.BoolVar(&rescueMode, "rescue", false, "keep going past unreadable source ranges, filling them on the destination")
+	flag.StringVar(&rescueMapPath, "rescue-map", "", "record unreadable source ranges in this file (implies -rescue)")
+	flag.StringVar(&rescueFill, "rescue-fill", "zero", "fill for unreadable ranges: zero, hex bytes as 0x..., or text")
+	flag.BoolVar(&rescueRetry, "rescue-retry", false, "only read the blocks listed in -rescue-map, rewrite it with what is still unreadable")
+	flag.BoolVar(&dedupEnabled, "dedup", true, "let the server copy blocks it already holds at another offset instead of receiving them")
+	flag.BoolVar(&atomicMode, "atomic", false, "write a temporary copy of a regular-file destination, rename it over the original after DONE")
+	flag.BoolVar(&verifyBlocks, "verify", false, "re-read the destination and compare hashes before acknowledging DONE")
+	flag.StringVar(&maxMemory, "max-memory", "", "budget for block buffers, i.e. '512M'; the reader waits while it is spent (default unlimited)")
+	flag.StringVar(&fsyncPolicy, "fsync", "end", "destination durability: none, end, block, or sync every N blocks")
+	flag.StringVar(&cacheMode, "cache", "normal", "page cache use: normal, dontneed (drop after use), direct (O_DIRECT)")
+	flag.BoolVar(&force, "force", false, "overwrite a destination device even if mounted, swap or in use")
+	flag.StringVar(&sizePolicy, "size", "match", "destination size policy: match, keep (never shrink), fail (never resize)")
+	flag.BoolVar(&dryRun, "dry-run", false, "compare blocks and report what would change, without sending or writing")
+	flag.StringVar(&progress, "progress", "text", "progress output format: text or json")
+	flag.IntVar(&progressFd, "progress-fd", 0, "write progress to this file descriptor instead of stdout")
+	flag.StringVar(&progressFile, "progress-file", "", "write progress to this file instead of stdout")
+	flag.DurationVar(&progressInterval, "progress-interval", time.Second, "interval between JSON progress objects")
+	flag.StringVar(&logLevel, "log-level", "info", "log level: error, warn, info, debug, trace")
+	flag.StringVar(&logFormat, "log-format", "text", "log format: text or json")
+	flag.StringVar(&logFilePath, "log-file", "", "append log to this file instead of stderr (reopened on SIGHUP)")
+	flag.StringVar(&session, "session", "", "session id added to log lines (default random, passed to -t server)")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve Prometheus metrics on this address, i.e. ':9100'")
+	flag.StringVar(&ctlSocket, "ctl", "", "control socket path for runtime changes (bwlimit/iolimit/status)")
+	flag.StringVar(&limitsFile, "limits-file", "", "file of bwlimit/iolimit commands, applied at start and re-read on SIGUSR1")
 
 	flag.Parse() // after declaring flags we need to call it
 
+	// Exit code is applied after all deferred cleanup has run
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	if listAllDrives {
-		listDrives()
+		if listFormat != "text" && listFormat != "json" {
+			Err("unknown list format: %s (use text or json)\n", listFormat)
+		}
+		listDrives(listFormat)
 		return
 	}
 
 	// Set compression level
 	SetCompressionLevel(compLevel)
+	if noCompress {
+		codecFlag = "none"
+	}
+	setCodec(codecFlag)
+
+	// Pipe mode: stdout carries the protocol from here on
+	if remoteAddr == pipeAddr || (remoteAddr == "" && port == pipeAddr) {
+		if sshTarget != "" {
+			Err("-t cannot be combined with -r - or -p -\n")
+		}
+		setupPipe()
+	}
+
+	SetupLogging(logLevel, logFormat, logFilePath, session)
+	setupProgress(progress, progressFd, progressFile)
+	handleSignals()
+	setZeroMode(zeroMode)
+	setSizePolicy(sizePolicy)
+	setCacheMode(cacheMode)
+	setFsyncPolicy(fsyncPolicy)
+	setSocketMode(socketMode)
+	setIPFamily(ipFamily)
+
+	// Rate limits
+	setupLimiter(netLimiter, bwLimit, bwSchedule)
+	setupLimiter(diskLimiter, ioLimit, ioSchedule)
+	if limitsFile != "" {
+		if err := loadLimitsFile(limitsFile); err != nil {
+			Err("limits file: %s\n", err.Error())
+		}
+		watchLimitsFile(limitsFile)
+	}
+	if metricsAddr != "" {
+		startMetrics(metricsAddr)
+	}
+	if ctlSocket != "" {
+		startControlSocket(ctlSocket)
+		defer removeControlSocket()
+	}
 
 	blockSize = uint32(bSize)
 
 	if blockSize == 0 {
 		Err("Block size cannot be zero\n")
 	}
+	setupMemory(maxMemory, blockSize, int(workers))
 
 	// Handle encryption
 	if encKeyReceived != "" {
@@ -73,9 +172,26 @@ func main() {
 		Log("encryption enabled with auto-generated key\n")
 	}
 
+	if dryRun && reverse {
+		Err("-dry-run is not supported in download mode (-d)\n")
+	}
+	if (atomicMode || verifyBlocks) && reverse {
+		Err("-atomic and -verify are not supported in download mode (-d)\n")
+	}
+	if dictTrain && (reverse || activeCodec != codecZstd) {
+		Err("-dict needs -codec zstd and is not supported in download mode (-d)\n")
+	}
+	setupRescue(reverse)
+
 	if sshTarget != "" {
-		_, host, _, _ := parseSSHTarget(sshTarget)
-		remoteAddr = host + ":" + port
+		if isLocalAddr(port) {
+			Err("-t needs a TCP port, not %s\n", port)
+		}
+		// -r may list other addresses of the host to stripe over
+		if remoteAddr == "" {
+			_, host, _, _ := parseSSHTarget(sshTarget)
+			remoteAddr = net.JoinHostPort(host, port)
+		}
 	}
 
 	if remoteAddr != "" {
@@ -97,7 +213,7 @@ func main() {
 				defer sshCmd.Wait()
 			}
 
-			file, err := os.OpenFile(device, os.O_RDWR|os.O_CREATE, 0666)
+			file, err := openDestination(device, false)
 			if err != nil {
 				if sshCmd != nil {
 					sshCmd.Process.Kill()
@@ -107,8 +223,10 @@ func main() {
 				return
 			}
 			defer file.Close()
+			setupCache(file, true)
 
 			startClientDownload(file, remoteAddr, uint32(skipIdx), blockSize, noCompress, int(workers))
+			exitCode = finishTransfer()
 
 			// cleanup SSH
 			if sshCmd != nil {
@@ -144,6 +262,7 @@ func main() {
 				return
 			}
 			defer file.Close()
+			setupCache(file, false)
 
 			fileSize := getDeviceSize(file)
 			if fileSize == 0 {
@@ -160,6 +279,7 @@ func main() {
 			// Note: startClient now handles checksum precomputation with sequential reader
 
 			startClient(file, remoteAddr, uint32(skipIdx), fileSize, blockSize, noCompress, checksumCache, int(workers))
+			exitCode = finishTransfer()
 
 			// cleanup SSH
 			if sshCmd != nil {
@@ -179,6 +299,7 @@ func main() {
 				return
 			}
 			defer file.Close()
+			setupCache(file, false)
 
 			fileSize := getDeviceSize(file)
 			if fileSize == 0 {
@@ -190,16 +311,28 @@ func main() {
 			go precomputeChecksums(file, blockSize, lastBlockNum, checksumCache, uint32(skipIdx), int(workers))
 
 			startServerUpload(file, bindIp, port, fileSize, checksumCache, int(workers))
+			exitCode = finishTransfer()
 		} else {
 			// SERVER: destination file (original download mode)
 			SetLog(logPrefix, "[server]", quiet)
 			Log("starting server, remote -> %s\n", device)
-			file, err := os.OpenFile(device, os.O_RDWR|os.O_CREATE, 0666)
+			if dryRun {
+				Log("dry-run: destination opened read-only\n")
+			}
+			var file *os.File
+			var err error
+			if atomicMode && !dryRun {
+				file, err = openAtomic(device)
+				defer abortAtomic()
+			} else {
+				file, err = openDestination(device, dryRun)
+			}
 			if err != nil {
 				Err("Error opening file: %s\n", err.Error())
 				return
 			}
 			defer file.Close()
+			setupCache(file, !dryRun)
 
 			fileSize := getDeviceSize(file)
 			var checksumCache *ChecksumCache
@@ -209,10 +342,21 @@ func main() {
 				go precomputeChecksums(file, blockSize, lastBlockNum, checksumCache, uint32(skipIdx), int(workers))
 			} else {
 				checksumCache = NewChecksumCache(0)
+				checksumCache.Set(0, eofBlockHash)
 				Log("destination file is empty, skipping precompute\n")
 			}
 
 			startServer(file, bindIp, port, checksumCache)
+			if err, ok := srvRefused.Load().(error); ok {
+				Err("transfer refused: %s\n", err.Error())
+			}
+			if err, ok := srvFinishErr.Load().(error); ok {
+				Err("finishing destination failed: %s\n", err.Error())
+			}
+			if atomicPending() {
+				Err("no DONE received, %s not replaced\n", device)
+			}
+			exitCode = finishTransfer()
 		}
 	}
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Counters exported on the -metrics HTTP listener in Prometheus text format.
+// All fields are updated atomically.
+var metrics struct {
+	blocksHashed       uint64
+	blocksSkipped      uint64
+	blocksRaw          uint64
+	blocksCompressed   uint64
+	blocksZero         uint64
+	blocksReused       uint64
+	unreadableBytes    uint64
+	bytesSent          uint64
+	bytesReceived      uint64
+	retries            uint64
+	reconnects         uint64
+	decompressFailures uint64
+	writeFailures      uint64
+	hashWaitNanos      uint64
+}
+
+// metricAdd increments a counter in the metrics struct
+func metricAdd(counter *uint64, n uint64) {
+	atomic.AddUint64(counter, n)
+}
+
+// metricHashWait records time spent blocked in ChecksumCache.WaitFor
+func metricHashWait(d time.Duration) {
+	atomic.AddUint64(&metrics.hashWaitNanos, uint64(d))
+}
+
+// startMetrics serves /metrics on addr in the background; an address that
+// cannot be bound is fatal
+func startMetrics(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		Err("metrics listener: %s\n", err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			Error("metrics listener: %s\n", err.Error())
+		}
+	}()
+	Log("metrics listening on http://%s/metrics\n", ln.Addr())
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	load := atomic.LoadUint64
+
+	counter("bsync_blocks_hashed_total", "Blocks hashed from the local file.", load(&metrics.blocksHashed))
+	counter("bsync_blocks_skipped_total", "Blocks already in sync with the remote side.", load(&metrics.blocksSkipped))
+
+	fmt.Fprintf(w, "# HELP bsync_blocks_sent_total Blocks transferred (sent by the source, received by the destination).\n")
+	fmt.Fprintf(w, "# TYPE bsync_blocks_sent_total counter\n")
+	fmt.Fprintf(w, "bsync_blocks_sent_total{kind=\"raw\"} %d\n", load(&metrics.blocksRaw))
+	fmt.Fprintf(w, "bsync_blocks_sent_total{kind=\"compressed\"} %d\n", load(&metrics.blocksCompressed))
+	fmt.Fprintf(w, "bsync_blocks_sent_total{kind=\"zero\"} %d\n", load(&metrics.blocksZero))
+
+	counter("bsync_blocks_reused_total", "Blocks the destination copied from its own data (-dedup).", load(&metrics.blocksReused))
+
+	fmt.Fprintf(w, "# HELP bsync_compress_skipped_blocks_total Incompressible blocks sent without compressing them.\n")
+	fmt.Fprintf(w, "# TYPE bsync_compress_skipped_blocks_total counter\n")
+	fmt.Fprintf(w, "bsync_compress_skipped_blocks_total{reason=\"entropy\"} %d\n", load(&compStats.skippedEntropy))
+	fmt.Fprintf(w, "bsync_compress_skipped_blocks_total{reason=\"region\"} %d\n", load(&compStats.skippedRegion))
+	_, saved := compressSavings()
+	fmt.Fprintf(w, "# HELP bsync_compress_saved_seconds_total Estimated compression CPU time saved by skipping incompressible blocks.\n")
+	fmt.Fprintf(w, "# TYPE bsync_compress_saved_seconds_total counter\n")
+	fmt.Fprintf(w, "bsync_compress_saved_seconds_total %f\n", saved.Seconds())
+
+	fmt.Fprintf(w, "# HELP bsync_wire_bytes_total Bytes on the wire.\n")
+	fmt.Fprintf(w, "# TYPE bsync_wire_bytes_total counter\n")
+	fmt.Fprintf(w, "bsync_wire_bytes_total{direction=\"sent\"} %d\n", load(&metrics.bytesSent))
+	fmt.Fprintf(w, "bsync_wire_bytes_total{direction=\"received\"} %d\n", load(&metrics.bytesReceived))
+
+	counter("bsync_retries_total", "Block transfer retries.", load(&metrics.retries))
+	counter("bsync_reconnects_total", "Reconnects of client connections.", load(&metrics.reconnects))
+	counter("bsync_decompress_failures_total", "Blocks that failed to decompress.", load(&metrics.decompressFailures))
+	counter("bsync_write_failures_total", "Blocks that failed to write.", load(&metrics.writeFailures))
+	counter("bsync_unreadable_bytes_total", "Source bytes that could not be read and were filled (-rescue).", load(&metrics.unreadableBytes))
+
+	fmt.Fprintf(w, "# HELP bsync_hash_wait_seconds_total Time spent waiting for precomputed hashes.\n")
+	fmt.Fprintf(w, "# TYPE bsync_hash_wait_seconds_total counter\n")
+	fmt.Fprintf(w, "bsync_hash_wait_seconds_total %f\n", time.Duration(load(&metrics.hashWaitNanos)).Seconds())
+
+	syncs, syncTime := fsyncStats()
+	counter("bsync_fsyncs_total", "Syncs of the destination for the -fsync policy.", syncs)
+	fmt.Fprintf(w, "# HELP bsync_fsync_seconds_total Time spent syncing the destination.\n")
+	fmt.Fprintf(w, "# TYPE bsync_fsync_seconds_total counter\n")
+	fmt.Fprintf(w, "bsync_fsync_seconds_total %f\n", syncTime.Seconds())
+
+	allocated, peak, waits := bufPool.stats()
+	fmt.Fprintf(w, "# HELP bsync_buffer_bytes Bytes of block buffers held by the buffer pool.\n")
+	fmt.Fprintf(w, "# TYPE bsync_buffer_bytes gauge\n")
+	fmt.Fprintf(w, "bsync_buffer_bytes %d\n", allocated)
+	fmt.Fprintf(w, "# HELP bsync_buffer_peak_bytes Most bytes of block buffers held at once.\n")
+	fmt.Fprintf(w, "# TYPE bsync_buffer_peak_bytes gauge\n")
+	fmt.Fprintf(w, "bsync_buffer_peak_bytes %d\n", peak)
+	counter("bsync_buffer_waits_total", "Buffer requests that waited for the -max-memory budget.", waits)
+
+	fmt.Fprintf(w, "# HELP bsync_active_connections Currently open server connections.\n")
+	fmt.Fprintf(w, "# TYPE bsync_active_connections gauge\n")
+	fmt.Fprintf(w, "bsync_active_connections %d\n", atomic.LoadInt64(&activeConns))
+}
@@ -6,7 +6,7 @@ import (
 )
 
 const magicLen = 17
-const magicHead = "blockSync-ver0.01"
+const magicHead = "blockSync-ver0.06"
 
 type Msg struct {
 	MagicHead  [magicLen]byte
@@ -15,8 +15,12 @@ type Msg struct {
 	FileSize   uint64
 	DataSize   uint32
 	Compressed bool
+	Codec      uint8 // codec of a Compressed payload
 	Zero       bool
 	Done       bool
+	DryRun     bool     // receiver must not write; payloads are discarded
+	Dict       bool     // payload is the session's zstd dictionary (-dict)
+	Hash       [16]byte // source block hash on hash requests, for -dedup
 }
 
 func stringToFixedSizeArray(s string) [magicLen]byte {
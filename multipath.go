@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Multi-path striping: -r takes several comma-separated server addresses,
+// one per uplink, and -local-addr the local IPs to dial them from (one for
+// all, or one per address). Transfer workers are spread across the paths.
+// A path whose connection fails is set aside for pathRetry and its workers
+// move to the others. Every pathInterval the paths' throughput per worker
+// is compared: a worker moves from a path below pathSlowFactor of the best
+// one to it, and a path back from a failure gets a worker again. Moves take
+// effect between blocks. The dictionary, the dry-run probe and DONE use the
+// first healthy path; download mode (-d) only fails over.
+const (
+	pathInterval   = 5 * time.Second
+	pathRetry      = 30 * time.Second
+	pathSlowFactor = 0.5
+	pathMinRate    = 1024 * 1024 // bytes/s per worker, below it nothing is compared
+)
+
+var localAddrs string
+
+type netPath struct {
+	ep        *endpoint
+	bytes     uint64 // atomic, since the last rebalance
+	total     uint64 // atomic
+	downUntil time.Time
+	failures  int
+}
+
+type pathSet struct {
+	mu      sync.Mutex
+	paths   []*netPath
+	assign  []int // worker -> path it should use
+	current []int // worker -> path of its connection, -1 without one
+	stop    chan struct{}
+}
+
+// newPathSet resolves the comma-separated server addresses for workers
+func newPathSet(addresses string, workers int) (*pathSet, error) {
+	addrs := strings.Split(addresses, ",")
+	var binds []string
+	if localAddrs != "" {
+		binds = strings.Split(localAddrs, ",")
+		if len(binds) != 1 && len(binds) != len(addrs) {
+			return nil, fmt.Errorf("-local-addr lists %d addresses for %d server addresses", len(binds), len(addrs))
+		}
+	}
+
+	ps := &pathSet{assign: make([]int, workers), current: make([]int, workers)}
+	for i, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		bind := ""
+		if len(binds) == 1 {
+			bind = strings.TrimSpace(binds[0])
+		} else if binds != nil {
+			bind = strings.TrimSpace(binds[i])
+		}
+		ep, err := resolveEndpointFrom(addr, bind)
+		if err != nil {
+			return nil, err
+		}
+		if ep.pipe && len(addrs) > 1 {
+			return nil, errors.New("the pipe (-) cannot be one of several paths")
+		}
+		if bind != "" {
+			ep.name += " from " + bind
+		}
+		ps.paths = append(ps.paths, &netPath{ep: ep})
+	}
+	for w := range ps.assign {
+		ps.assign[w] = w % len(ps.paths)
+		ps.current[w] = -1
+	}
+	if len(ps.paths) > 1 {
+		Log("multi-path: %d paths: %s\n", len(ps.paths), ps.names())
+	}
+	return ps, nil
+}
+
+func (ps *pathSet) names() string {
+	var names []string
+	for _, p := range ps.paths {
+		names = append(names, p.ep.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// pipe tells whether the only path is stdin/stdout
+func (ps *pathSet) pipe() bool {
+	return ps.paths[0].ep.pipe
+}
+
+// worker returns the endpoint transfer worker w dials
+func (ps *pathSet) worker(w int) *endpoint {
+	if len(ps.paths) == 1 {
+		return ps.paths[0].ep
+	}
+	return &endpoint{
+		name:   ps.names(),
+		dial:   func() (net.Conn, error) { return ps.dialWorker(w) },
+		failed: func(err error) { ps.failWorker(w, err) },
+		moved: func() bool {
+			ps.mu.Lock()
+			defer ps.mu.Unlock()
+			return ps.current[w] != ps.assign[w]
+		},
+	}
+}
+
+// shared returns an endpoint dialing the healthy paths first, in order
+func (ps *pathSet) shared() *endpoint {
+	if len(ps.paths) == 1 {
+		return ps.paths[0].ep
+	}
+	return &endpoint{
+		name: ps.names(),
+		dial: func() (net.Conn, error) {
+			var err error
+			for _, i := range ps.order() {
+				var c net.Conn
+				if c, err = ps.paths[i].ep.dial(); err == nil {
+					return &pathConn{Conn: c, p: ps.paths[i]}, nil
+				}
+				ps.fail(i, err)
+			}
+			return nil, err
+		},
+	}
+}
+
+func (ps *pathSet) dialWorker(w int) (net.Conn, error) {
+	ps.mu.Lock()
+	i := ps.assign[w]
+	if ps.paths[i].downUntil.After(time.Now()) {
+		if j := ps.leastLoaded(); j >= 0 {
+			i = j
+			ps.assign[w] = j
+		}
+	}
+	ps.mu.Unlock()
+
+	p := ps.paths[i]
+	Debug("multi-path: worker %d dials %s\n", w, p.ep.name)
+	c, err := p.ep.dial()
+	if err != nil {
+		ps.fail(i, err)
+		return nil, err
+	}
+	ps.mu.Lock()
+	ps.current[w] = i
+	ps.mu.Unlock()
+	return &pathConn{Conn: c, p: p}, nil
+}
+
+func (ps *pathSet) failWorker(w int, err error) {
+	ps.mu.Lock()
+	i := ps.current[w]
+	ps.current[w] = -1
+	ps.mu.Unlock()
+	if i >= 0 {
+		ps.fail(i, err)
+	}
+}
+
+// fail sets path i aside and moves its workers to the healthy paths
+func (ps *pathSet) fail(i int, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p := ps.paths[i]
+	p.failures++
+	if !p.downUntil.After(time.Now()) {
+		Warn("multi-path: %s failed: %s, setting it aside for %s\n", p.ep.name, err, pathRetry)
+	}
+	p.downUntil = time.Now().Add(pathRetry)
+	for w, a := range ps.assign {
+		if a == i {
+			if j := ps.leastLoaded(); j >= 0 {
+				ps.assign[w] = j
+			}
+		}
+	}
+}
+
+// leastLoaded returns the healthy path with the fewest workers, -1 if
+// every path is set aside; caller holds mu
+func (ps *pathSet) leastLoaded() int {
+	workers := ps.workerCounts()
+	best := -1
+	now := time.Now()
+	for i, p := range ps.paths {
+		if p.downUntil.After(now) {
+			continue
+		}
+		if best < 0 || workers[i] < workers[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// workerCounts returns the workers assigned to each path; caller holds mu
+func (ps *pathSet) workerCounts() []int {
+	workers := make([]int, len(ps.paths))
+	for _, a := range ps.assign {
+		workers[a]++
+	}
+	return workers
+}
+
+// order returns the path indexes, healthy ones first
+func (ps *pathSet) order() []int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var up, down []int
+	now := time.Now()
+	for i, p := range ps.paths {
+		if p.downUntil.After(now) {
+			down = append(down, i)
+		} else {
+			up = append(up, i)
+		}
+	}
+	return append(up, down...)
+}
+
+// start runs the rebalancer until stopPaths
+func (ps *pathSet) start() {
+	if len(ps.paths) == 1 {
+		return
+	}
+	ps.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pathInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ps.rebalance(pathInterval)
+			case <-ps.stop:
+				return
+			}
+		}
+	}()
+}
+
+// rebalance moves at most one worker: to a healthy path without any, or
+// from a slow path to the fastest one
+func (ps *pathSet) rebalance(interval time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := time.Now()
+	workers := ps.workerCounts()
+	rates := make([]float64, len(ps.paths)) // bytes/s per worker
+	best, worst, idle, busiest := -1, -1, -1, -1
+	for i, p := range ps.paths {
+		n := atomic.SwapUint64(&p.bytes, 0)
+		if workers[i] > 1 && (busiest < 0 || workers[i] > workers[busiest]) {
+			busiest = i
+		}
+		if p.downUntil.After(now) {
+			continue
+		}
+		if workers[i] == 0 {
+			idle = i
+			continue
+		}
+		rates[i] = float64(n) / interval.Seconds() / float64(workers[i])
+		if best < 0 || rates[i] > rates[best] {
+			best = i
+		}
+		if worst < 0 || rates[i] < rates[worst] {
+			worst = i
+		}
+	}
+
+	switch {
+	case idle >= 0 && busiest >= 0:
+		ps.move(busiest, idle)
+		Log("multi-path: %s is back, moving a worker to it from %s\n", ps.paths[idle].ep.name, ps.paths[busiest].ep.name)
+	case best >= 0 && worst != best && workers[worst] > 1 && rates[best] >= pathMinRate &&
+		rates[worst] < pathSlowFactor*rates[best]:
+		ps.move(worst, best)
+		Log("multi-path: moving a worker from %s (%0.1f MB/s per worker) to %s (%0.1f MB/s per worker)\n",
+			ps.paths[worst].ep.name, rates[worst]/mb1, ps.paths[best].ep.name, rates[best]/mb1)
+	}
+}
+
+// move reassigns the last worker of path from to path to; caller holds mu
+func (ps *pathSet) move(from, to int) {
+	for w := len(ps.assign) - 1; w >= 0; w-- {
+		if ps.assign[w] == from {
+			ps.assign[w] = to
+			return
+		}
+	}
+}
+
+// stopPaths stops the rebalancer and logs what went over each path
+func (ps *pathSet) stopPaths() {
+	if ps.stop == nil {
+		return
+	}
+	close(ps.stop)
+	ps.stop = nil
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, p := range ps.paths {
+		Log("multi-path: %s: %d bytes, %d failures\n", p.ep.name, atomic.LoadUint64(&p.total), p.failures)
+	}
+}
+
+// pathConn counts the bytes moved over a path
+type pathConn struct {
+	net.Conn
+	p *netPath
+}
+
+func (c *pathConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.p.count(n)
+	return n, err
+}
+
+func (c *pathConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.p.count(n)
+	return n, err
+}
+
+func (p *netPath) count(n int) {
+	atomic.AddUint64(&p.bytes, uint64(n))
+	atomic.AddUint64(&p.total, uint64(n))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Pipe mode (-r - on the client, -p - on the server): the protocol runs
+// over stdin/stdout, so any byte pipe carrying both directions can be the
+// transport (socat, ssh, kubectl exec -i). There is a single stream: the
+// client sends the dictionary, the blocks and DONE over it in turn, with one
+// transfer connection (-w still sets the hashing and compression workers).
+// A broken stream cannot be redialed and aborts the transfer, resume it
+// with -s. Stdout belongs to the protocol, READY and progress go to stderr.
+const pipeAddr = "-"
+
+var stdioPipe *pipeConn
+
+// pipeConn is stdin/stdout as a net.Conn. Deadlines are not supported
+// (the pipe's own transport times out, if anything); Close does not close
+// the stream, which is shared by the client's connections in turn.
+type pipeConn struct {
+	in  io.Reader
+	out io.Writer
+
+	mu  sync.Mutex
+	err error // first failure, the stream is out of step after it
+}
+
+// setupPipe takes stdin/stdout for the protocol and sends everything else
+// printed to stdout to stderr
+func setupPipe() {
+	stdioPipe = &pipeConn{in: os.Stdin, out: os.Stdout}
+	if progressOut == io.Writer(os.Stdout) {
+		progressOut = os.Stderr
+	}
+	os.Stdout = os.Stderr
+	// A closed stdout is an error to report, not a signal to die from
+	signal.Ignore(syscall.SIGPIPE)
+}
+
+// pipeEndpoint dials the pipe; once it failed, the transfer is over
+func pipeEndpoint() *endpoint {
+	return &endpoint{
+		name: "stdin/stdout",
+		pipe: true,
+		dial: func() (net.Conn, error) {
+			if err := stdioPipe.failed(); err != nil {
+				Err("pipe: stream broken (%s), it cannot be reconnected; resume with -s\n", err)
+			}
+			return stdioPipe, nil
+		},
+	}
+}
+
+// servePipe runs a server handler on the pipe, then closes stdout so the
+// other side sees the end of the stream
+func servePipe(handle func(net.Conn)) {
+	Ready("READY, serving on stdin/stdout\n")
+	handle(stdioPipe)
+	if c, ok := stdioPipe.out.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (p *pipeConn) Read(b []byte) (int, error) {
+	n, err := p.in.Read(b)
+	if err != nil {
+		p.fail(err)
+	}
+	return n, err
+}
+
+func (p *pipeConn) Write(b []byte) (int, error) {
+	n, err := p.out.Write(b)
+	if err != nil {
+		p.fail(err)
+	}
+	return n, err
+}
+
+func (p *pipeConn) fail(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+}
+
+func (p *pipeConn) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *pipeConn) Close() error                       { return nil }
+func (p *pipeConn) LocalAddr() net.Addr                { return pipeNetAddr{} }
+func (p *pipeConn) RemoteAddr() net.Addr               { return pipeNetAddr{} }
+func (p *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (p *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (p *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type pipeNetAddr struct{}
+
+func (pipeNetAddr) Network() string { return "pipe" }
+func (pipeNetAddr) String() string  { return "stdin/stdout" }
+
+var _ net.Conn = (*pipeConn)(nil)
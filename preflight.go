@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// -force: overwrite a destination device even if it is mounted, used as swap
+// or held by another driver (LVM, md, dm-crypt)
+var force bool
+
+// openDestination opens the file or device bsync writes to. Block devices are
+// checked for mounts, swap and holders first and opened exclusively, so a
+// second writer (or a later mount) fails instead of racing with us.
+func openDestination(path string, readOnly bool) (*os.File, error) {
+	if readOnly {
+		return os.OpenFile(path, os.O_RDONLY, 0)
+	}
+
+	reason, err := deviceInUse(path)
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight check of %s: %w", path, err)
+	}
+	if reason != "" {
+		if !force {
+			return nil, fmt.Errorf("%s is %s, refusing to overwrite it (use -force to override)", path, reason)
+		}
+		Warn("%s is %s, overwriting it anyway (-force)\n", path, reason)
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	excl := 0
+	if !force {
+		excl = exclusiveFlag(path)
+	}
+	if excl != 0 {
+		// O_EXCL without O_CREAT means an exclusive open of a block device
+		flags = os.O_RDWR | excl
+	}
+	file, err := os.OpenFile(path, flags, 0666)
+	if err != nil && excl != 0 {
+		return nil, fmt.Errorf("%w (device busy: opened by another process? use -force to override)", err)
+	}
+	return file, err
+}
+
+// parseMountinfo maps "major:minor" of every mounted filesystem to its mount
+// points, and the mount sources (i.e. /dev/mapper/vg-root) likewise, from the
+// /proc/self/mountinfo format
+func parseMountinfo(r io.Reader) (mounts map[string][]string, sources map[string][]string) {
+	mounts = make(map[string][]string)
+	sources = make(map[string][]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		line := scanner.Text()
+		sep := strings.Index(line, " - ")
+		if sep < 0 {
+			continue
+		}
+		fields := strings.Fields(line[:sep])
+		tail := strings.Fields(line[sep+3:])
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := unescapeMount(fields[4])
+		mounts[fields[2]] = append(mounts[fields[2]], mountPoint)
+		if len(tail) >= 2 && strings.HasPrefix(tail[1], "/dev/") {
+			src := unescapeMount(tail[1])
+			sources[src] = append(sources[src], mountPoint)
+		}
+	}
+	return mounts, sources
+}
+
+// unescapeMount decodes the octal escapes (\040 for space) used in mountinfo and /proc/swaps
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				sb.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// unescapeUdev decodes the \xHH escapes udev uses in /dev/disk link names
+func unescapeUdev(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				sb.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
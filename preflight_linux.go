@@ -0,0 +1,115 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceInUse returns why the block device at path must not be overwritten,
+// or "" if it is free (or not a block device)
+func deviceInUse(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return "", nil
+		}
+		return "", err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", nil
+	}
+
+	// The device and its partitions, "major:minor" -> sysfs name
+	devs := blockDevTree(st.Rdev)
+
+	if f, err := os.Open("/proc/self/mountinfo"); err == nil {
+		mounts, sources := parseMountinfo(f)
+		f.Close()
+		for num, name := range devs {
+			if mnt, ok := mounts[num]; ok {
+				return fmt.Sprintf("mounted (%s on %s)", name, mnt[0]), nil
+			}
+		}
+		// btrfs and friends report an anonymous major:minor, match the source
+		for src, mnt := range sources {
+			if name, ok := devs[devNumber(src)]; ok {
+				return fmt.Sprintf("mounted (%s on %s)", name, mnt[0]), nil
+			}
+		}
+	}
+
+	if data, err := os.ReadFile("/proc/swaps"); err == nil {
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if name, ok := devs[devNumber(unescapeMount(fields[0]))]; ok {
+				return fmt.Sprintf("used as swap (%s)", name), nil
+			}
+		}
+	}
+
+	// LVM PVs, md members and dm-crypt backing devices have holders
+	for _, name := range devs {
+		holders, _ := os.ReadDir(filepath.Join("/sys/class/block", name, "holders"))
+		if len(holders) == 0 {
+			continue
+		}
+		holder := holders[0].Name()
+		if dmName, err := os.ReadFile(filepath.Join("/sys/class/block", holder, "dm", "name")); err == nil {
+			holder += " " + strings.TrimSpace(string(dmName))
+		}
+		return fmt.Sprintf("in use (%s held by %s)", name, holder), nil
+	}
+
+	return "", nil
+}
+
+// blockDevTree lists the block device rdev and its partitions from sysfs
+func blockDevTree(rdev uint64) map[string]string {
+	num := fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev))
+	devs := map[string]string{num: num}
+
+	dir, err := filepath.EvalSymlinks("/sys/dev/block/" + num)
+	if err != nil {
+		return devs
+	}
+	devs[num] = filepath.Base(dir)
+
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(dir, e.Name(), "partition")); err != nil {
+			continue
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, e.Name(), "dev")); err == nil {
+			devs[strings.TrimSpace(string(data))] = e.Name()
+		}
+	}
+	return devs
+}
+
+// devNumber returns "major:minor" of the block device at path, "" otherwise
+func devNumber(path string) string {
+	var st unix.Stat_t
+	if unix.Stat(path, &st) != nil || st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev))
+}
+
+// exclusiveFlag returns O_EXCL for block devices: Linux then refuses the open
+// while the device is mounted or opened exclusively by someone else
+func exclusiveFlag(path string) int {
+	if devNumber(path) == "" {
+		return 0
+	}
+	return unix.O_EXCL
+}
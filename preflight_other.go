@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+// deviceInUse is only implemented on Linux
+func deviceInUse(path string) (string, error) {
+	return "", nil
+}
+
+func exclusiveFlag(path string) int {
+	return 0
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Machine-readable progress (-progress json): one JSON object per interval
+// on progressOut, followed by a final report when the transfer ends.
+var (
+	progressMode               = "text"
+	progressInterval           = time.Second
+	progressOut      io.Writer = os.Stdout
+
+	prog     progressState
+	progStop chan struct{}
+	progDone sync.WaitGroup
+)
+
+type progressState struct {
+	mu         sync.Mutex
+	role       string
+	start      time.Time
+	fileSize   uint64
+	blockSize  uint32
+	skipIdx    uint32
+	lastBlock  uint32
+	blocksDone uint64
+	bytesRead  uint64 // source/destination bytes covered by processed blocks
+	bytesSent  uint64 // payload bytes on the wire
+	bytesOrig  uint64 // original size of blocks sent (for ratio)
+	diffs      uint64
+	indicators map[string]uint64
+	failed     []uint32
+	finished   bool
+}
+
+// ProgressEvent is emitted every progressInterval
+type ProgressEvent struct {
+	Type       string  `json:"type"`
+	Role       string  `json:"role"`
+	Time       string  `json:"time"`
+	BlocksDone uint64  `json:"blocks_done"`
+	BlocksTot  uint64  `json:"blocks_total"`
+	BytesRead  uint64  `json:"bytes_read"`
+	BytesSent  uint64  `json:"bytes_sent"`
+	Ratio      float64 `json:"compression_ratio"`
+	Diffs      uint64  `json:"diffs"`
+	RateMBs    float64 `json:"rate_mbs"`
+	EtaSec     int64   `json:"eta_sec"`
+}
+
+// ProgressReport is emitted once at the end of the transfer
+type ProgressReport struct {
+	Type        string            `json:"type"`
+	Role        string            `json:"role"`
+	Status      string            `json:"status"`
+	ExitCode    int               `json:"exit_code"`
+	Error       string            `json:"error,omitempty"`
+	FileSize    uint64            `json:"file_size"`
+	BlockSize   uint32            `json:"block_size"`
+	BlocksDone  uint64            `json:"blocks_done"`
+	BlocksTot   uint64            `json:"blocks_total"`
+	BytesRead   uint64            `json:"bytes_read"`
+	BytesSent   uint64            `json:"bytes_sent"`
+	Ratio       float64           `json:"compression_ratio"`
+	Diffs       uint64            `json:"diffs"`
+	DurationSec float64           `json:"duration_sec"`
+	RateMBs     float64           `json:"rate_mbs"`
+	Indicators  map[string]uint64 `json:"indicators"`
+	Failed      []uint32          `json:"failed_blocks"`
+	Syncs       uint64            `json:"syncs"`
+	SyncSec     float64           `json:"sync_sec"`
+	Unreadable  uint64            `json:"unreadable_bytes"`
+	CompLevels  map[string]uint64 `json:"compression_levels,omitempty"` // blocks per level with -L auto
+	CompSkipped uint64            `json:"compress_skipped_blocks"`
+	CompSaved   float64           `json:"compress_saved_sec"`
+	DryRun      *DryRunReport     `json:"dry_run,omitempty"`
+}
+
+func progressJSON() bool {
+	return progressMode == "json"
+}
+
+// setupProgress validates -progress flags and opens the output
+func setupProgress(mode string, fd int, path string) {
+	switch mode {
+	case "text", "json":
+		progressMode = mode
+	default:
+		Err("unknown progress mode: %s (use text or json)\n", mode)
+	}
+
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			Err("opening progress file: %s\n", err.Error())
+		}
+		progressOut = f
+	} else if fd > 0 {
+		progressOut = os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	}
+
+	// In pipe mode stdout is the protocol stream, also when reached through
+	// another descriptor or /dev/stdout
+	if stdioPipe != nil && sameFile(progressOut, stdioPipe.out) {
+		Err("progress output is stdout, which carries the protocol with -r - or -p - (use -progress-fd 2 or a file)\n")
+	}
+}
+
+// sameFile reports whether two writers are the same open file
+func sameFile(a, b io.Writer) bool {
+	fa, ok1 := a.(*os.File)
+	fb, ok2 := b.(*os.File)
+	if !ok1 || !ok2 {
+		return false
+	}
+	sa, err1 := fa.Stat()
+	sb, err2 := fb.Stat()
+	return err1 == nil && err2 == nil && os.SameFile(sa, sb)
+}
+
+// startProgress resets counters and starts the periodic JSON emitter
+func startProgress(role string, fileSize uint64, blockSize uint32, skipIdx uint32) {
+	prog.mu.Lock()
+	prog.role = role
+	prog.start = time.Now()
+	prog.fileSize = fileSize
+	prog.blockSize = blockSize
+	prog.skipIdx = skipIdx
+	if fileSize > 0 {
+		prog.lastBlock = uint32((fileSize - 1) / uint64(blockSize))
+	}
+	prog.indicators = make(map[string]uint64)
+	started := progStop != nil
+	if !started {
+		progStop = make(chan struct{})
+	}
+	prog.mu.Unlock()
+
+	if !progressJSON() || started {
+		return
+	}
+	progDone.Add(1)
+	go func() {
+		defer progDone.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				writeProgress(prog.event())
+			case <-progStop:
+				return
+			}
+		}
+	}()
+}
+
+// progressBlock records one processed block
+func progressBlock(indicator string, readBytes, netBytes uint64, diff bool) {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	if prog.indicators == nil {
+		prog.indicators = make(map[string]uint64)
+	}
+	prog.blocksDone++
+	prog.bytesRead += readBytes
+	prog.indicators[indicator]++
+	if netBytes > 0 {
+		prog.bytesSent += netBytes
+		prog.bytesOrig += readBytes
+	}
+	if diff {
+		prog.diffs++
+	}
+}
+
+// progressUpdate re-labels a block already counted as "-" once its data
+// arrives (server side: the hash request comes first, the payload later)
+func progressUpdate(indicator string, readBytes, netBytes uint64) {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	if prog.indicators == nil {
+		prog.indicators = make(map[string]uint64)
+	}
+	if prog.indicators["-"] > 0 {
+		prog.indicators["-"]--
+	}
+	prog.indicators[indicator]++
+	prog.diffs++
+	if netBytes > 0 {
+		prog.bytesSent += netBytes
+		prog.bytesOrig += readBytes
+	}
+}
+
+// progressFailed records a block that could not be transferred
+func progressFailed(blockIdx uint32) {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	prog.failed = append(prog.failed, blockIdx)
+}
+
+// progressRecovered forgets the failures of a block written on a retry
+func progressRecovered(blockIdx uint32) {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	kept := prog.failed[:0]
+	for _, idx := range prog.failed {
+		if idx != blockIdx {
+			kept = append(kept, idx)
+		}
+	}
+	prog.failed = kept
+}
+
+// progressFailedCount returns the number of failed blocks so far
+func progressFailedCount() int {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	return len(prog.failed)
+}
+
+// event builds an interval snapshot
+func (p *progressState) event() ProgressEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := uint64(p.lastBlock-p.skipIdx) + 1
+	elapsed := time.Since(p.start).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(p.bytesRead) / mb1 / elapsed
+	}
+	var eta int64
+	if rate > 0 && p.blocksDone < total {
+		left := float64(total-p.blocksDone) * float64(p.blockSize) / mb1
+		eta = int64(left / rate)
+	}
+
+	return ProgressEvent{
+		Type:       "progress",
+		Role:       p.role,
+		Time:       time.Now().Format(time.RFC3339),
+		BlocksDone: p.blocksDone,
+		BlocksTot:  total,
+		BytesRead:  p.bytesRead,
+		BytesSent:  p.bytesSent,
+		Ratio:      p.ratio(),
+		Diffs:      p.diffs,
+		RateMBs:    rate,
+		EtaSec:     eta,
+	}
+}
+
+// ratio is the percentage of bytes on the wire vs original; caller holds mu
+func (p *progressState) ratio() float64 {
+	if p.bytesOrig == 0 {
+		return 100.0
+	}
+	return 100.0 * float64(p.bytesSent) / float64(p.bytesOrig)
+}
+
+// finishProgress stops the emitter and writes the final report (JSON mode
+// only). Safe to call more than once; only the first call reports.
+func finishProgress(status string, exitCode int, errMsg string) {
+	prog.mu.Lock()
+	if prog.finished {
+		prog.mu.Unlock()
+		return
+	}
+	prog.finished = true
+	stop := progStop
+	prog.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		progDone.Wait()
+	}
+	if !progressJSON() {
+		return
+	}
+
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+
+	var duration, rate float64
+	if !prog.start.IsZero() {
+		duration = time.Since(prog.start).Seconds()
+	}
+	if duration > 0 {
+		rate = float64(prog.bytesRead) / mb1 / duration
+	}
+	failed := append([]uint32{}, prog.failed...)
+	sort.Slice(failed, func(i, j int) bool { return failed[i] < failed[j] })
+
+	syncs, syncTime := fsyncStats()
+	compSkipped, compSaved := compressSavings()
+
+	var dry *DryRunReport
+	if dryRun && prog.role == "client" {
+		dry = dryRunResult()
+	}
+
+	writeProgress(ProgressReport{
+		Type:        "report",
+		Role:        prog.role,
+		Status:      status,
+		ExitCode:    exitCode,
+		Error:       errMsg,
+		FileSize:    prog.fileSize,
+		BlockSize:   prog.blockSize,
+		BlocksDone:  prog.blocksDone,
+		BlocksTot:   uint64(prog.lastBlock-prog.skipIdx) + 1,
+		BytesRead:   prog.bytesRead,
+		BytesSent:   prog.bytesSent,
+		Ratio:       prog.ratio(),
+		Diffs:       prog.diffs,
+		DurationSec: duration,
+		RateMBs:     rate,
+		Indicators:  prog.indicators,
+		Failed:      failed,
+		Syncs:       syncs,
+		SyncSec:     syncTime.Seconds(),
+		Unreadable:  rescue.unreadableBytes(),
+		CompLevels:  adaptLevels(),
+		CompSkipped: compSkipped,
+		CompSaved:   compSaved.Seconds(),
+		DryRun:      dry,
+	})
+}
+
+// finishTransfer writes the final report and returns the process exit code
+func finishTransfer() int {
+	logMemory()
+	if n := progressFailedCount(); n > 0 {
+		finishProgress("failed", 1, fmt.Sprintf("%d blocks failed", n))
+		return 1
+	}
+	finishProgress("ok", 0, "")
+	return 0
+}
+
+func writeProgress(v interface{}) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	progressOut.Write(append(line, '\n'))
+}
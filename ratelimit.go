@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Global limiters: network send rate (connWrite) and disk read rate
+// (SequentialReader, precomputeChecksums). Zero rate means unlimited.
+var (
+	netLimiter  = NewRateLimiter("net")
+	diskLimiter = NewRateLimiter("disk")
+
+	// flag values, also passed to a server spawned via -t
+	bwLimit    string
+	bwSchedule string
+	ioLimit    string
+	ioSchedule string
+)
+
+// RateLimiter is a token bucket limiting throughput in bytes per second.
+// The bucket holds at most one second worth of tokens.
+type RateLimiter struct {
+	name     string
+	mu       sync.Mutex
+	rate     float64 // bytes per second, 0 = unlimited
+	tokens   float64
+	last     time.Time
+	base     uint64          // rate set by flag or control socket
+	schedule []scheduleEntry // optional time-of-day overrides
+	manual   bool            // control socket override disables schedule
+}
+
+// scheduleEntry applies rate between from and to (minutes since midnight)
+type scheduleEntry struct {
+	from, to int
+	rate     uint64
+}
+
+func NewRateLimiter(name string) *RateLimiter {
+	return &RateLimiter{name: name, last: time.Now()}
+}
+
+// Enabled reports whether a limit is currently in effect
+func (rl *RateLimiter) Enabled() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.rate > 0
+}
+
+// Rate returns the current limit in bytes per second (0 = unlimited)
+func (rl *RateLimiter) Rate() uint64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return uint64(rl.rate)
+}
+
+// setRate changes the limit; caller holds mu. Returns true if it changed.
+func (rl *RateLimiter) setRate(rate uint64) bool {
+	if float64(rate) == rl.rate {
+		return false
+	}
+	rl.rate = float64(rate)
+	rl.tokens = 0
+	rl.last = time.Now()
+	return true
+}
+
+// SetBase sets the limit used outside of scheduled windows
+func (rl *RateLimiter) SetBase(rate uint64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.base = rate
+	rl.apply(time.Now())
+}
+
+// SetManual overrides the schedule with a fixed rate until ResumeSchedule
+func (rl *RateLimiter) SetManual(rate uint64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.manual = true
+	rl.setRate(rate)
+}
+
+// ResumeSchedule drops a manual override and re-applies base rate/schedule
+func (rl *RateLimiter) ResumeSchedule() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.manual = false
+	rl.apply(time.Now())
+}
+
+// SetSchedule installs time-of-day windows and starts the update loop
+func (rl *RateLimiter) SetSchedule(entries []scheduleEntry) {
+	rl.mu.Lock()
+	rl.schedule = entries
+	rl.apply(time.Now())
+	rl.mu.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(30 * time.Second) {
+			rl.mu.Lock()
+			if rl.apply(time.Now()) {
+				Log("%s limit scheduled -> %s\n", rl.name, formatRate(uint64(rl.rate)))
+			}
+			rl.mu.Unlock()
+		}
+	}()
+}
+
+// apply picks the rate for time t; caller holds mu
+func (rl *RateLimiter) apply(t time.Time) bool {
+	if rl.manual {
+		return false
+	}
+	return rl.setRate(scheduledRate(rl.schedule, rl.base, t))
+}
+
+// scheduledRate returns the rate of the first window containing t, or base
+func scheduledRate(entries []scheduleEntry, base uint64, t time.Time) uint64 {
+	m := t.Hour()*60 + t.Minute()
+	for _, e := range entries {
+		if e.from <= e.to {
+			if m >= e.from && m < e.to {
+				return e.rate
+			}
+		} else if m >= e.from || m < e.to {
+			// window wraps around midnight
+			return e.rate
+		}
+	}
+	return base
+}
+
+// Wait blocks until n bytes may pass. Large requests may overdraw the
+// bucket; the debt is paid off by sleeping before returning.
+func (rl *RateLimiter) Wait(n int) {
+	rl.mu.Lock()
+	if rl.rate <= 0 {
+		rl.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	var delay time.Duration
+	if rl.tokens < 0 {
+		delay = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	}
+	rl.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// parseRate parses "0", "512K", "50M", "1G" (bytes per second)
+func parseRate(s string) (uint64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	if s == "" || s == "0" || s == "OFF" {
+		return 0, nil
+	}
+	mult := uint64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate: %q", s)
+	}
+	return uint64(v * float64(mult)), nil
+}
+
+func formatRate(rate uint64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%0.2f MB/s", float64(rate)/mb1)
+}
+
+// parseSchedule parses "08:00-18:00=10M,18:00-08:00=0"
+func parseSchedule(s string) ([]scheduleEntry, error) {
+	var entries []scheduleEntry
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		window, rateStr, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule entry: %q", part)
+		}
+		fromStr, toStr, ok := strings.Cut(window, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule window: %q", window)
+		}
+		from, err := parseClock(fromStr)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(toStr)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := parseRate(rateStr)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, scheduleEntry{from: from, to: to, rate: rate})
+	}
+	return entries, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// setupLimiter configures a limiter from its rate and schedule flags
+func setupLimiter(rl *RateLimiter, rate, schedule string) {
+	r, err := parseRate(rate)
+	if err != nil {
+		Err("%s limit: %v\n", rl.name, err)
+	}
+	entries, err := parseSchedule(schedule)
+	if err != nil {
+		Err("%s schedule: %v\n", rl.name, err)
+	}
+	rl.SetBase(r)
+	rl.SetSchedule(entries)
+}
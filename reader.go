@@ -10,14 +10,17 @@ import (
 type BlockData struct {
 	BlockIdx uint32
 	Data     []byte
+	Zero     bool // block lies in a hole of a sparse file; Data is nil
 }
 
 // SequentialReader reads blocks sequentially and pushes to channel
 type SequentialReader struct {
 	file         *os.File
 	blockSize    uint32
+	fileSize     uint64
 	lastBlockNum uint32
 	skipIdx      uint32
+	holes        *dataMap
 	blockChan    chan BlockData
 	wg           sync.WaitGroup
 }
@@ -29,8 +32,10 @@ func NewSequentialReader(file *os.File, blockSize uint32, fileSize uint64, skipI
 	return &SequentialReader{
 		file:         file,
 		blockSize:    blockSize,
+		fileSize:     fileSize,
 		lastBlockNum: lastBlock,
 		skipIdx:      skipIdx,
+		holes:        loadDataMap(file),
 		blockChan:    make(chan BlockData, bufferAhead),
 	}
 }
@@ -42,21 +47,39 @@ func (sr *SequentialReader) Start() {
 		defer sr.wg.Done()
 		defer close(sr.blockChan)
 
-		buf := make([]byte, sr.blockSize)
+		var holeBlocks uint32
 		for blockIdx := sr.skipIdx; blockIdx <= sr.lastBlockNum; blockIdx++ {
 			// Read block sequentially
 			offset := int64(blockIdx) * int64(sr.blockSize)
-			n, err := sr.file.ReadAt(buf, offset)
-			if err != nil && err != io.EOF {
-				Log("sequential reader error reading block %d: %s\n", blockIdx, err)
-				return
+
+			// Unallocated range of a sparse file: zero without reading
+			if sr.holes.isHole(offset, int64(sr.blockSize)) {
+				holeBlocks++
+				sr.blockChan <- BlockData{BlockIdx: blockIdx, Zero: true}
+				continue
 			}
 
-			// Copy data and push to channel
-			dataCopy := make([]byte, n)
-			copy(dataCopy, buf[:n])
+			// -rescue-retry: only blocks with unreadable ranges
+			if !rescue.wanted(offset, int64(sr.blockSize)) {
+				continue
+			}
 
-			sr.blockChan <- BlockData{BlockIdx: blockIdx, Data: dataCopy}
+			// Each block gets its own pool buffer, released once it is sent
+			buf := bufPool.Get(int(sr.blockSize))
+			diskLimiter.Wait(len(buf))
+			n, err := readAt(sr.file, buf, offset)
+			if err != nil && err != io.EOF {
+				if !rescueMode {
+					Err("sequential reader error reading block %d: %s (-rescue continues past unreadable ranges)\n", blockIdx, err)
+				}
+				n = int(blockLen(blockIdx, sr.blockSize, sr.fileSize))
+				rescue.add(rescueRead(sr.file, buf[:n], offset))
+			}
+
+			sr.blockChan <- BlockData{BlockIdx: blockIdx, Data: buf[:n]}
+		}
+		if holeBlocks > 0 {
+			Log("sequential reader: %d hole blocks skipped without reading\n", holeBlocks)
 		}
 	}()
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rescue mode (-rescue) for failing source disks: a block that fails to
+// read is read again in ever smaller pieces, pieces that still fail are
+// filled with -rescue-fill and recorded in the -rescue-map file, and the
+// transfer goes on. A later run with -rescue-retry reads only the blocks
+// listed in the map and rewrites it with what is still unreadable.
+var (
+	rescueMode    bool
+	rescueMapPath string
+	rescueFill    = "zero"
+	rescueRetry   bool
+
+	rescuePattern []byte // nil fills with zeros
+	rescue        rescueState
+)
+
+// Read sizes tried on a failing range, largest first
+var rescueSteps = []int{64 * 1024, 4096, 512}
+
+type badRange struct {
+	Off int64
+	Len int64
+}
+
+type rescueState struct {
+	mu      sync.Mutex
+	bad     []badRange // unreadable in this run, in offset order
+	retry   []badRange // loaded from the map for -rescue-retry
+	readTo  int64      // -rescue-retry has read the source up to here
+	bytes   uint64
+	skipped uint32 // blocks not read by -rescue-retry
+}
+
+// setupRescue validates the rescue flags and loads the map for a retry pass
+func setupRescue(reverse bool) {
+	if rescueRetry && rescueMapPath == "" {
+		Err("-rescue-retry needs the -rescue-map of an earlier run\n")
+	}
+	if rescueRetry || rescueMapPath != "" {
+		rescueMode = true
+	}
+	if !rescueMode {
+		return
+	}
+	if reverse {
+		Err("-rescue reads the local source, it is not available with -d\n")
+	}
+
+	pattern, err := parseFillPattern(rescueFill)
+	if err != nil {
+		Err("invalid -rescue-fill: %s\n", err.Error())
+	}
+	rescuePattern = pattern
+
+	if rescueRetry {
+		f, err := os.Open(rescueMapPath)
+		if err != nil {
+			Err("opening rescue map: %s\n", err.Error())
+		}
+		ranges, err := parseRescueMap(f)
+		f.Close()
+		if err != nil {
+			Err("reading rescue map %s: %s\n", rescueMapPath, err.Error())
+		}
+		rescue.retry = ranges
+		Log("rescue: retry pass over %d unreadable ranges from %s\n", len(ranges), rescueMapPath)
+	}
+}
+
+// parseFillPattern accepts "zero", hex bytes as "0x..." or literal text
+func parseFillPattern(s string) ([]byte, error) {
+	switch {
+	case s == "" || s == "zero":
+		return nil, nil
+	case strings.HasPrefix(s, "0x"):
+		pattern, err := hex.DecodeString(s[2:])
+		if err != nil {
+			return nil, err
+		}
+		if len(pattern) == 0 {
+			return nil, errors.New("empty hex pattern")
+		}
+		return pattern, nil
+	}
+	return []byte(s), nil
+}
+
+// parseRescueMap reads "offset length" lines, numbers in decimal or 0x hex;
+// blank lines, '#' comments and extra fields are ignored
+func parseRescueMap(r io.Reader) ([]badRange, error) {
+	var ranges []badRange
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want offset and length", line)
+		}
+		off, err1 := strconv.ParseInt(fields[0], 0, 64)
+		length, err2 := strconv.ParseInt(fields[1], 0, 64)
+		if err1 != nil || err2 != nil || off < 0 || length <= 0 {
+			return nil, fmt.Errorf("line %d: invalid range %q", line, scanner.Text())
+		}
+		ranges = append(ranges, badRange{Off: off, Len: length})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Off < ranges[j].Off })
+	return ranges, scanner.Err()
+}
+
+// writeRescueMap replaces the map file, so a crash never leaves half of it
+func writeRescueMap(path string, ranges []badRange) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintf(w, "# bsync rescue map, %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# unreadable source ranges: offset length (bytes)\n")
+	for _, r := range ranges {
+		fmt.Fprintf(w, "0x%08X  0x%08X\n", r.Off, r.Len)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// wanted reports whether -rescue-retry should read the range
+func (rs *rescueState) wanted(off, length int64) bool {
+	if !rescueRetry {
+		return true
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	i := sort.Search(len(rs.retry), func(i int) bool { return rs.retry[i].Off+rs.retry[i].Len > off })
+	if i < len(rs.retry) && rs.retry[i].Off < off+length {
+		rs.readTo = off + length
+		return true
+	}
+	rs.skipped++
+	return false
+}
+
+// mapRanges returns what the map should list: the ranges unreadable in this
+// run and, on a retry pass, those of the old map not read again yet, so an
+// interrupted retry loses nothing; caller holds mu
+func (rs *rescueState) mapRanges() []badRange {
+	ranges := append([]badRange(nil), rs.bad...)
+	if !rescueRetry {
+		return ranges
+	}
+	for _, r := range rs.retry {
+		if end := r.Off + r.Len; end > rs.readTo {
+			if r.Off < rs.readTo {
+				r = badRange{Off: rs.readTo, Len: end - rs.readTo}
+			}
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// add records the unreadable ranges of one block and updates the map
+func (rs *rescueState) add(ranges []badRange) {
+	if len(ranges) == 0 {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, r := range ranges {
+		Warn("rescue: %d bytes unreadable at offset %d, filled\n", r.Len, r.Off)
+		rs.bytes += uint64(r.Len)
+		metricAdd(&metrics.unreadableBytes, uint64(r.Len))
+		if n := len(rs.bad); n > 0 && rs.bad[n-1].Off+rs.bad[n-1].Len == r.Off {
+			rs.bad[n-1].Len += r.Len
+			continue
+		}
+		rs.bad = append(rs.bad, r)
+	}
+	if rescueMapPath != "" {
+		if err := writeRescueMap(rescueMapPath, rs.mapRanges()); err != nil {
+			Error("writing rescue map: %s\n", err.Error())
+		}
+	}
+}
+
+// unreadableBytes returns the bytes filled so far
+func (rs *rescueState) unreadableBytes() uint64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.bytes
+}
+
+// rescueFinish writes the final map and logs the summary
+func rescueFinish() {
+	if !rescueMode {
+		return
+	}
+	rescue.mu.Lock()
+	defer rescue.mu.Unlock()
+
+	if rescueRetry {
+		Log("rescue: %d blocks outside the map skipped\n", rescue.skipped)
+	}
+	if rescueMapPath != "" {
+		if err := writeRescueMap(rescueMapPath, rescue.mapRanges()); err != nil {
+			Error("writing rescue map: %s\n", err.Error())
+		}
+	}
+	if len(rescue.bad) == 0 {
+		Log("rescue: no unreadable ranges\n")
+		return
+	}
+	Warn("rescue: %d unreadable ranges, %d bytes filled with %s\n", len(rescue.bad), rescue.bytes, rescueFill)
+	if rescueMapPath != "" {
+		Log("rescue: map written to %s, retry with -rescue-retry\n", rescueMapPath)
+	}
+}
+
+// rescueRead fills buf from off, splitting failed reads into smaller pieces;
+// what still fails at the smallest size is filled and returned
+func rescueRead(file *os.File, buf []byte, off int64) []badRange {
+	return rescueSpan(file, buf, off, 0)
+}
+
+func rescueSpan(file *os.File, buf []byte, off int64, step int) []badRange {
+	n, err := readAt(file, buf, off)
+	if n == len(buf) && (err == nil || err == io.EOF) {
+		return nil
+	}
+
+	for step < len(rescueSteps) && rescueSteps[step] >= len(buf) {
+		step++
+	}
+	if step == len(rescueSteps) {
+		fillPattern(buf, off)
+		return []badRange{{Off: off, Len: int64(len(buf))}}
+	}
+
+	var bad []badRange
+	size := rescueSteps[step]
+	for pos := 0; pos < len(buf); pos += size {
+		end := pos + size
+		if end > len(buf) {
+			end = len(buf)
+		}
+		for _, r := range rescueSpan(file, buf[pos:end], off+int64(pos), step+1) {
+			if k := len(bad); k > 0 && bad[k-1].Off+bad[k-1].Len == r.Off {
+				bad[k-1].Len += r.Len
+				continue
+			}
+			bad = append(bad, r)
+		}
+	}
+	return bad
+}
+
+// fillPattern writes the -rescue-fill pattern, aligned to the file offset so
+// filled ranges read the same wherever a block boundary falls
+func fillPattern(buf []byte, off int64) {
+	if len(rescuePattern) == 0 {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return
+	}
+	p := int64(len(rescuePattern))
+	for i := range buf {
+		buf[i] = rescuePattern[(off+int64(i))%p]
+	}
+}
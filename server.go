@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -17,6 +18,8 @@ var (
 	activeConns   int64
 	doneReceived  int32
 	shutdownTimer *time.Timer
+	srvRefused    atomic.Value // error from the -size policy, transfer refused
+	srvFinishErr  atomic.Value // error from the final sync, verify or replace
 
 	// Server-side progress stats
 	suppressProgress bool // set via -P flag when launched as remote server via -t
@@ -30,7 +33,7 @@ var (
 )
 
 func serverPrintStats(blockIdx uint32, indicator string, netBytes uint32) {
-	if suppressProgress {
+	if suppressProgress || progressJSON() {
 		return
 	}
 	if netBytes > 0 {
@@ -78,7 +81,7 @@ func serverPrintStats(blockIdx uint32, indicator string, netBytes uint32) {
 	}
 	diffs := atomic.LoadInt32(&srvDiffs)
 
-	Log("recv block %d/%d (%0.2f%%) [%s] size=%d ratio=%0.2f %0.2f MB/s ETA=%d %s diffs=%d\r",
+	Progress("recv block %d/%d (%0.2f%%) [%s] size=%d ratio=%0.2f %0.2f MB/s ETA=%d %s diffs=%d\r",
 		blockIdx, last, percent, indicator, srvFileSize, ratio, mbs, eta, etaUnit, diffs)
 }
 
@@ -92,7 +95,8 @@ func serverHandleReq(conn net.Conn, file *os.File, checksumCache *ChecksumCache)
 
 	magicBytes := stringToFixedSizeArray(magicHead)
 
-	filebuf := make([]byte, blockSize)
+	var filebuf []byte
+	defer func() { bufPool.Put(filebuf) }()
 	msgBuf := make([]byte, binary.Size(Msg{}))
 
 	var lastBlockNum uint32 = 0
@@ -100,6 +104,10 @@ func serverHandleReq(conn net.Conn, file *os.File, checksumCache *ChecksumCache)
 	c := bufio.NewReader(conn)
 
 	for {
+		// An idle connection holds no buffer
+		bufPool.Put(filebuf)
+		filebuf = nil
+
 		conn.SetDeadline(time.Now().Add(ioTimeout))
 		_, err1 := io.ReadFull(c, msgBuf)
 		if err1 != nil {
@@ -109,7 +117,7 @@ func serverHandleReq(conn net.Conn, file *os.File, checksumCache *ChecksumCache)
 
 		msg, err2 := unpack(msgBuf)
 		if err2 != nil {
-			Log("\t- unpack msg failed: %s\n", err2)
+			Error("\t- unpack msg failed: %s\n", err2)
 		}
 
 		if msg.MagicHead != magicBytes {
@@ -117,13 +125,25 @@ func serverHandleReq(conn net.Conn, file *os.File, checksumCache *ChecksumCache)
 			return
 		}
 
-		if debug {
-			Log("\t- unpacked Msg-> %v\n", msg)
-		}
+		Debug("\t- unpacked Msg-> %v\n", msg)
 
 		if msg.BlockSize != blockSize {
 			blockSize = msg.BlockSize
-			filebuf = make([]byte, blockSize)
+		}
+
+		// Everything the message needs comes from one pool call, so no
+		// connection waits for a second buffer while holding the first;
+		// a compressed block is decoded into the second half
+		need := int(blockSize)
+		if msg.Compressed {
+			need *= 2
+		}
+		filebuf = bufPool.GetInFlight(need)
+		outbuf := filebuf[blockSize:need]
+		filebuf = filebuf[:blockSize]
+		if msg.DataSize > blockSize && !msg.Dict {
+			Error("\t- block of %d bytes is larger than the block size\n", msg.DataSize)
+			return
 		}
 
 		offset := int64(msg.BlockIdx) * int64(blockSize)
@@ -131,71 +151,123 @@ func serverHandleReq(conn net.Conn, file *os.File, checksumCache *ChecksumCache)
 		if msg.FileSize > 0 {
 			if lastBlockNum == 0 {
 				lastBlockNum = uint32((msg.FileSize - 1) / uint64(blockSize))
-				truncateIfRegularFile(file, msg.FileSize)
 				srvOnce.Do(func() {
+					if err := applySizePolicy(file, msg.FileSize, msg.DryRun); err != nil {
+						Error("size policy %s: %s\n", sizePolicy, err.Error())
+						srvRefused.Store(err)
+					}
 					srvFileSize = msg.FileSize
 					atomic.StoreUint32(&srvLastBlockNum, lastBlockNum)
 					srvT0 = time.Now()
+					startProgress("server", msg.FileSize, blockSize, 0)
 				})
 			}
 		}
 
+		// Refused by the size policy: answer hash requests with the marker
+		// so the client aborts instead of retrying
+		if srvRefused.Load() != nil {
+			if msg.Dict || (!msg.Done && !msg.Zero && msg.DataSize == 0) {
+				connWrite(conn, refusedHash)
+			}
+			return
+		}
+
+		// Session dictionary, sent before the transfer workers connect
+		if msg.Dict {
+			if err := receiveDictionary(c, conn, msg.DataSize); err != nil {
+				Error("\t- dictionary: %s\n", err)
+				return
+			}
+			continue
+		}
+
+		// Dry-run: drain payloads (link probe), never write
+		if msg.DryRun && !msg.Done && (msg.Zero || msg.DataSize > 0) {
+			if msg.DataSize > 0 {
+				if _, err := io.ReadFull(c, filebuf[:msg.DataSize]); err != nil {
+					Error("\t- (dry-run) connection closed: %s\n", err)
+					return
+				}
+				metricAdd(&metrics.bytesReceived, uint64(msg.DataSize))
+			}
+			continue
+		}
+
 		// Handle zero blocks (Zero=true, DataSize=0) - no data sent
 		if msg.Zero && msg.DataSize == 0 {
-			// Check if destination block is already zero or doesn't exist (EOF)
+			// Check if destination block is already zero or doesn't exist (EOF),
+			// an evicted hash (nil) is zeroed anyway
 			destHash := checksumCache.WaitFor(msg.BlockIdx)
-			if bytes.Equal(destHash, zeroBlockHash) || string(destHash) == "EOF" {
+			if bytes.Equal(destHash, zeroBlockHash) || bytes.Equal(destHash, eofBlockHash) {
 				// Destination already zero or beyond file size - nothing to do
-				if debug {
-					Log("\t- zero block at offset %d, already zero/EOF, skipping\n", offset)
-				}
+				Debug("\t- zero block at offset %d, already zero/EOF, skipping\n", offset)
+				metricAdd(&metrics.blocksSkipped, 1)
 				serverPrintStats(msg.BlockIdx, "-", 0)
 				continue
 			}
 
-			// Destination is non-zero - write zeros to overwrite
-			if debug {
-				Log("\t- zero block at offset %d, writing zeros to overwrite\n", offset)
+			// Destination is non-zero - punch a hole or write zeros to overwrite
+			Debug("\t- zero block at offset %d, zeroing (%s)\n", offset, zeroMode)
+			if err := zeroRange(file, offset, int64(blockLen(msg.BlockIdx, blockSize, msg.FileSize))); err != nil {
+				Error("\t- error writing zero block: %s\n", err.Error())
+				metricAdd(&metrics.writeFailures, 1)
+				progressFailed(msg.BlockIdx)
+				break
 			}
-			zero := getZeroBuf(int(blockSize))
-			n, err := file.WriteAt(zero, offset)
-			if err != nil && err != io.EOF {
-				Log("\t- error writing zero block: [%d] %s\n", n, err.Error())
+			if err := syncWritten(file); err != nil {
+				Error("\t- sync failed: %s\n", err.Error())
+				metricAdd(&metrics.writeFailures, 1)
+				progressFailed(msg.BlockIdx)
 				break
 			}
 			checksumCache.Set(msg.BlockIdx, zeroBlockHash)
+			progressRecovered(msg.BlockIdx)
+			metricAdd(&metrics.blocksZero, 1)
+			progressUpdate(".", blockLen(msg.BlockIdx, blockSize, srvFileSize), 0)
 			serverPrintStats(msg.BlockIdx, ".", 0)
 			continue
 		}
 
-		if msg.DataSize == 0 {
-			if debug {
-				Log("\t- read block from file\n")
-			}
+		if msg.DataSize == 0 && !msg.Done {
+			Debug("\t- read block from file\n")
 
-			n, err := file.ReadAt(filebuf, offset)
+			n, err := readAt(file, filebuf, offset)
 			if err != nil && err != io.EOF {
-				Log("\t- error reading from file: [%d] %s\n", n, err.Error())
+				Error("\t- error reading from file: [%d] %s\n", n, err.Error())
 				break
 			}
 
-			// if debug { Log("\t- wait for precomputed hash\n") }
+			// Trace("\t- wait for precomputed hash\n")
 			hash := checksumCache.WaitFor(msg.BlockIdx)
+			if hash == nil {
+				hash = blockHash(filebuf[:n])
+			}
 
-			if debug {
-				Log("\t- send hash [%d] %x\n", msg.BlockIdx, hash)
+			// Content we already hold elsewhere: copy it locally instead
+			if dedupEnabled && !bytes.Equal(hash, msg.Hash[:]) && reuseBlock(file, checksumCache, msg, filebuf) {
+				if err := connWrite(conn, copiedHash); err != nil {
+					Error("\t- send copied marker failed: %s\n", err)
+					return
+				}
+				progressRecovered(msg.BlockIdx)
+				metricAdd(&metrics.blocksReused, 1)
+				progressBlock("r", blockLen(msg.BlockIdx, blockSize, srvFileSize), 0, true)
+				serverPrintStats(msg.BlockIdx, "r", 0)
+				continue
 			}
+
+			Debug("\t- send hash [%d] %x\n", msg.BlockIdx, hash)
 			if err := connWrite(conn, hash[:]); err != nil {
-				Log("\t- send hash failed: %s\n", err)
+				Error("\t- send hash failed: %s\n", err)
 				return
 			}
+			progressBlock("-", blockLen(msg.BlockIdx, blockSize, srvFileSize), 0, false)
 			serverPrintStats(msg.BlockIdx, "-", 0)
 		}
 
 		if msg.DataSize > 0 {
-			if debug {
-				Log("\t- read block from network %d\n", msg.DataSize)
-			}
+			Debug("\t- read block from network %d\n", msg.DataSize)
 
 			conn.SetDeadline(time.Now().Add(ioTimeout))
 			_, err1 := io.ReadFull(c, filebuf[:msg.DataSize])
@@ -203,35 +275,56 @@ func serverHandleReq(conn net.Conn, file *os.File, checksumCache *ChecksumCache)
 				Log("\t- (2) connection closed: %s\n", err1)
 				return
 			}
+			metricAdd(&metrics.bytesReceived, uint64(msg.DataSize))
 
 			if msg.Compressed {
-				decompressed, err := decompressData(filebuf[:msg.DataSize])
+				decompressed, err := decompressData(outbuf, filebuf[:msg.DataSize], msg.Codec, int(blockLen(msg.BlockIdx, blockSize, msg.FileSize)))
 				if err != nil {
-					Log("\t- error uncompressing: %s\n", err.Error())
+					Error("\t- error uncompressing: %s\n", err.Error())
+					metricAdd(&metrics.decompressFailures, 1)
+					progressFailed(msg.BlockIdx)
 					break
 				}
 
-				if debug {
-					Log("\t- write uncompressed bytes: %d [%d bytes]\n", msg.DataSize, len(decompressed))
-				}
-				n, err2 := file.WriteAt(decompressed, offset)
+				Debug("\t- write uncompressed bytes: %d [%d bytes]\n", msg.DataSize, len(decompressed))
+				n, err2 := writeAt(file, decompressed, offset)
 				if err2 != nil && err2 != io.EOF {
-					Log("\t- error writing to file: [%d] %s\n", n, err2.Error())
+					Error("\t- error writing to file: [%d] %s\n", n, err2.Error())
+					metricAdd(&metrics.writeFailures, 1)
+					progressFailed(msg.BlockIdx)
+					break
+				}
+				if err := syncWritten(file); err != nil {
+					Error("\t- sync failed: %s\n", err.Error())
+					metricAdd(&metrics.writeFailures, 1)
+					progressFailed(msg.BlockIdx)
 					break
 				}
 				checksumCache.Set(msg.BlockIdx, checksum(decompressed))
+				progressRecovered(msg.BlockIdx)
+				metricAdd(&metrics.blocksCompressed, 1)
+				progressUpdate("c", uint64(len(decompressed)), uint64(msg.DataSize))
 				serverPrintStats(msg.BlockIdx, "c", msg.DataSize)
 			} else {
 
-				if debug {
-					Log("\t- write non-compressed bytes: %d\n", msg.DataSize)
-				}
-				n, err2 := file.WriteAt(filebuf[:msg.DataSize], offset)
+				Debug("\t- write non-compressed bytes: %d\n", msg.DataSize)
+				n, err2 := writeAt(file, filebuf[:msg.DataSize], offset)
 				if err2 != nil && err2 != io.EOF {
-					Log("\t- error reading from file: [%d] %s\n", n, err2.Error())
+					Error("\t- error reading from file: [%d] %s\n", n, err2.Error())
+					metricAdd(&metrics.writeFailures, 1)
+					progressFailed(msg.BlockIdx)
+					break
+				}
+				if err := syncWritten(file); err != nil {
+					Error("\t- sync failed: %s\n", err.Error())
+					metricAdd(&metrics.writeFailures, 1)
+					progressFailed(msg.BlockIdx)
 					break
 				}
 				checksumCache.Set(msg.BlockIdx, checksum(filebuf[:msg.DataSize]))
+				progressRecovered(msg.BlockIdx)
+				metricAdd(&metrics.blocksRaw, 1)
+				progressUpdate("w", uint64(msg.DataSize), uint64(msg.DataSize))
 				serverPrintStats(msg.BlockIdx, "w", msg.DataSize)
 			}
 		}
@@ -240,6 +333,34 @@ func serverHandleReq(conn net.Conn, file *os.File, checksumCache *ChecksumCache)
 		if msg.Done {
 			Log("\ntransfer DONE message received, starting graceful shutdown\n")
 			atomic.StoreInt32(&doneReceived, 1)
+
+			// Acknowledge only once every block is written and synced
+			reply := doneAckHash
+			if !msg.DryRun {
+				err := waitOtherConns()
+				if err == nil {
+					err = syncFile(file)
+					logSyncStats()
+				}
+				if n := progressFailedCount(); err == nil && n > 0 {
+					err = fmt.Errorf("%d blocks failed on the server", n)
+				}
+				if err == nil && verifyBlocks {
+					err = verifyDestination(file, checksumCache, msg.FileSize, blockSize)
+				}
+				if err == nil && atomicMode {
+					err = commitAtomic(file)
+				}
+				if err != nil {
+					Error("finishing destination failed: %s\n", err.Error())
+					srvFinishErr.Store(err)
+					reply = finishFailedHash
+				}
+			}
+			if err := connWrite(conn, reply); err != nil {
+				Error("\t- send DONE acknowledgement failed: %s\n", err)
+			}
+
 			// Start shutdown timer in main loop
 			if shutdownTimer != nil {
 				shutdownTimer.Reset(10 * time.Second)
@@ -250,20 +371,35 @@ func serverHandleReq(conn net.Conn, file *os.File, checksumCache *ChecksumCache)
 	}
 }
 
+// waitOtherConns waits, at most ioTimeout, for the other connections to
+// finish writing: the client closes them before sending DONE
+func waitOtherConns() error {
+	deadline := time.Now().Add(ioTimeout)
+	for atomic.LoadInt64(&activeConns) > 1 {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%d other connections still active after %s", atomic.LoadInt64(&activeConns)-1, ioTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
 func startServer(file *os.File, bindIp, port string, checksumCache *ChecksumCache) {
-	bindTo := ":" + port
-	if bindIp != "0.0.0.0" {
-		bindTo = bindIp + ":" + port
+	if port == pipeAddr {
+		atomic.AddInt64(&activeConns, 1)
+		servePipe(func(c net.Conn) { serverHandleReq(c, file, checksumCache) })
+		atomic.AddInt64(&activeConns, -1)
+		return
 	}
 
-	listener, err := net.Listen("tcp", bindTo)
+	listener, bindTo, err := listen(bindIp, port)
 	if err != nil {
 		Err("listening: %s\n", err.Error())
 		return
 	}
 	defer listener.Close()
 
-	Log("READY, listening on %s\n", bindTo)
+	Ready("READY, listening on %s\n", bindTo)
 
 	// Context for cancellation
 	ctx, cancel := context.WithCancel(context.Background())
@@ -315,12 +451,11 @@ func startServer(file *os.File, bindIp, port string, checksumCache *ChecksumCach
 			shutdownTimer.Stop() // Stop shutdown timer when new activity
 			atomic.AddInt64(&activeConns, 1)
 			go func(c net.Conn) {
-				defer atomic.AddInt64(&activeConns, -1)
 				serverHandleReq(c, file, checksumCache)
+				active := atomic.AddInt64(&activeConns, -1)
 
 				// Check if we should exit after DONE
 				if atomic.LoadInt32(&doneReceived) == 1 {
-					active := atomic.LoadInt64(&activeConns)
 					if active == 0 {
 						Log("All connections finished after DONE, exiting\n")
 						return
@@ -329,14 +464,14 @@ func startServer(file *os.File, bindIp, port string, checksumCache *ChecksumCach
 				}
 
 				// Normal idle timer (only when NOT done)
-				if atomic.LoadInt64(&activeConns) == 0 && hadConnection && atomic.LoadInt32(&doneReceived) == 0 {
+				if active == 0 && hadConnection && atomic.LoadInt32(&doneReceived) == 0 {
 					Log("Last connection closed, starting idle timer\n")
 					idleTimer.Reset(2 * time.Second)
 				}
 			}(conn)
 
 		case err := <-errChan:
-			Log("Error accepting: %s\n", err.Error())
+			Error("Error accepting: %s\n", err.Error())
 			return
 
 		case <-idleTimer.C:
@@ -359,27 +494,31 @@ func startServer(file *os.File, bindIp, port string, checksumCache *ChecksumCach
 
 // startServerUpload serves file blocks to requesting clients (upload mode)
 func startServerUpload(file *os.File, bindIp, port string, fileSize uint64, checksumCache *ChecksumCache, workers int) {
-	bindTo := ":" + port
-	if bindIp != "0.0.0.0" {
-		bindTo = bindIp + ":" + port
+	if port == pipeAddr {
+		servePipe(func(c net.Conn) { serverHandleUpload(c, file, fileSize, checksumCache) })
+		return
 	}
 
-	listener, err := net.Listen("tcp", bindTo)
+	listener, bindTo, err := listen(bindIp, port)
 	if err != nil {
 		Err("listening: %s\n", err.Error())
 		return
 	}
 	defer listener.Close()
 
-	Log("READY for upload, listening on %s\n", bindTo)
+	Ready("READY for upload, listening on %s\n", bindTo)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			Log("Error accepting: %s\n", err.Error())
+			Error("Error accepting: %s\n", err.Error())
 			return
 		}
-		go serverHandleUpload(conn, file, fileSize, checksumCache)
+		atomic.AddInt64(&activeConns, 1)
+		go func(c net.Conn) {
+			defer atomic.AddInt64(&activeConns, -1)
+			serverHandleUpload(c, file, fileSize, checksumCache)
+		}(conn)
 	}
 }
 
@@ -395,7 +534,8 @@ func serverHandleUpload(conn net.Conn, file *os.File, fileSize uint64, checksumC
 
 	magicBytes := stringToFixedSizeArray(magicHead)
 
-	filebuf := make([]byte, blockSize)
+	var filebuf []byte
+	defer func() { bufPool.Put(filebuf) }()
 	msgBuf := make([]byte, binary.Size(Msg{}))
 
 	lastBlockNum := uint32((fileSize - 1) / uint64(blockSize))
@@ -403,6 +543,10 @@ func serverHandleUpload(conn net.Conn, file *os.File, fileSize uint64, checksumC
 	c := bufio.NewReader(conn)
 
 	for {
+		// An idle connection holds no buffer
+		bufPool.Put(filebuf)
+		filebuf = nil
+
 		conn.SetDeadline(time.Now().Add(ioTimeout))
 		_, err1 := io.ReadFull(c, msgBuf)
 		if err1 != nil {
@@ -412,7 +556,7 @@ func serverHandleUpload(conn net.Conn, file *os.File, fileSize uint64, checksumC
 
 		msg, err2 := unpack(msgBuf)
 		if err2 != nil {
-			Log("\t- unpack msg failed: %s\n", err2)
+			Error("\t- unpack msg failed: %s\n", err2)
 			return
 		}
 
@@ -421,9 +565,7 @@ func serverHandleUpload(conn net.Conn, file *os.File, fileSize uint64, checksumC
 			return
 		}
 
-		if debug {
-			Log("\t- unpacked upload Msg-> %v\n", msg)
-		}
+		Debug("\t- unpacked upload Msg-> %v\n", msg)
 
 		// If this is the first request, send file metadata
 		if msg.BlockIdx == 0 && msg.FileSize == 0 {
@@ -438,13 +580,13 @@ func serverHandleUpload(conn net.Conn, file *os.File, fileSize uint64, checksumC
 				Done:       false,
 			})
 			if err1 != nil {
-				Log("cant pack metadata msg-> %s\n", err1)
+				Error("cant pack metadata msg-> %s\n", err1)
 				return
 			}
 
 			n, err2 := conn.Write(metaMsg)
 			if err2 != nil && err2 != io.EOF {
-				Log("\t- error writing metadata: [%d] %s\n", n, err2.Error())
+				Error("\t- error writing metadata: [%d] %s\n", n, err2.Error())
 				return
 			}
 			continue
@@ -466,27 +608,39 @@ func serverHandleUpload(conn net.Conn, file *os.File, fileSize uint64, checksumC
 				Done:       true,
 			})
 			if err1 != nil {
-				Log("cant pack done msg-> %s\n", err1)
+				Error("cant pack done msg-> %s\n", err1)
 				return
 			}
 
 			n, err2 := conn.Write(doneMsg)
 			if err2 != nil && err2 != io.EOF {
-				Log("\t- error writing done msg: [%d] %s\n", n, err2.Error())
+				Error("\t- error writing done msg: [%d] %s\n", n, err2.Error())
 				return
 			}
 			return
 		}
 
+		// The block and room to compress it, from one pool call
+		need := int(blockSize)
+		if activeCodec != codecNone {
+			need += compressBound(need)
+		}
+		filebuf = bufPool.GetInFlight(need)
+		out := filebuf[blockSize:need]
+		filebuf = filebuf[:blockSize]
+
 		// Read block from file
-		n, err := file.ReadAt(filebuf, offset)
+		n, err := readAt(file, filebuf, offset)
 		if err != nil && err != io.EOF {
-			Log("\t- error reading from file: [%d] %s\n", n, err.Error())
+			Error("\t- error reading from file: [%d] %s\n", n, err.Error())
 			break
 		}
 
 		// Get precomputed hash
 		hash := checksumCache.WaitFor(msg.BlockIdx)
+		if hash == nil {
+			hash = blockHash(filebuf[:n])
+		}
 
 		// Check if block is zero - send only Msg, NO data (sparse file optimization)
 		if bytes.Equal(hash, zeroBlockHash) {
@@ -501,24 +655,29 @@ func serverHandleUpload(conn net.Conn, file *os.File, fileSize uint64, checksumC
 				Done:       false,
 			})
 			if err1 != nil {
-				Log("\t- cant pack zero msg-> %s\n", err1)
+				Error("\t- cant pack zero msg-> %s\n", err1)
 				return
 			}
 			connWrite(conn, respMsg)
+			metricAdd(&metrics.blocksZero, 1)
 			// DON'T send filebuf[:n] - client knows it's zero, will create sparse hole
 			continue
 		}
 
 		// Compress if beneficial
-		compBuf, err := compressData(filebuf[:n])
-		if err != nil {
-			Log("Error: compressing upload data: %s\n", err)
-			break
+		var compBuf []byte
+		var codec uint8
+		err = errIncompressible
+		if worthCompressing(msg.BlockIdx, filebuf[:n]) {
+			compBuf, codec, err = compressData(out, filebuf[:n])
+		}
+		if err != nil && err != errIncompressible {
+			Debug("\t- compressing block %d with %s: %s, sending raw\n", msg.BlockIdx, codecName(codec), err)
 		}
 
 		compressedBytes := uint32(len(compBuf))
 
-		if compressedBytes < uint32(n) {
+		if err == nil && compressedBytes < uint32(n) {
 			// Send compressed
 			msg, err1 := pack(&Msg{
 				MagicHead:  magicBytes,
@@ -527,15 +686,17 @@ func serverHandleUpload(conn net.Conn, file *os.File, fileSize uint64, checksumC
 				FileSize:   fileSize,
 				DataSize:   compressedBytes,
 				Compressed: true,
+				Codec:      codec,
 				Zero:       false,
 				Done:       false,
 			})
 			if err1 != nil {
-				Log("\t- cant pack compressed msg-> %s\n", err1)
+				Error("\t- cant pack compressed msg-> %s\n", err1)
 				return
 			}
 			connWrite(conn, msg)
 			connWrite(conn, compBuf)
+			metricAdd(&metrics.blocksCompressed, 1)
 		} else {
 			// Send uncompressed
 			msg, err1 := pack(&Msg{
@@ -549,15 +710,14 @@ func serverHandleUpload(conn net.Conn, file *os.File, fileSize uint64, checksumC
 				Done:       false,
 			})
 			if err1 != nil {
-				Log("\t- cant pack uncompressed msg-> %s\n", err1)
+				Error("\t- cant pack uncompressed msg-> %s\n", err1)
 				return
 			}
 			connWrite(conn, msg)
 			connWrite(conn, filebuf[:n])
+			metricAdd(&metrics.blocksRaw, 1)
 		}
 
-		if debug {
-			Log("\t- sent block [%d] %d bytes\n", msg.BlockIdx, n)
-		}
+		Debug("\t- sent block [%d] %d bytes\n", msg.BlockIdx, n)
 	}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local transports: besides host:port, the server's -p and the client's -r
+// take unix:/path for a Unix domain socket and vsock:cid:port for AF_VSOCK
+// between a hypervisor host and its guests (Linux only). Neither goes
+// through the TCP stack or exposes a port. -socket-mode sets the
+// permissions of the Unix socket file, by default they follow the umask.
+const (
+	unixPrefix  = "unix:"
+	vsockPrefix = "vsock:"
+
+	vsockCIDAny   = 0xFFFFFFFF // listen on every CID
+	vsockCIDLocal = 1          // loopback, vsock_loopback module
+	vsockCIDHost  = 2
+)
+
+var errVsockUnsupported = errors.New("vsock is only supported on Linux")
+
+var (
+	socketMode string
+	socketPerm os.FileMode // 0: leave the umask default
+)
+
+// setSocketMode parses -socket-mode, an octal permission like 0660
+func setSocketMode(s string) {
+	if s == "" {
+		return
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		Err("invalid -socket-mode: %s (use octal permissions, i.e. 0660)\n", s)
+	}
+	socketPerm = os.FileMode(mode)
+}
+
+// isLocalAddr tells whether a -p or -r value is a unix: or vsock: address
+func isLocalAddr(s string) bool {
+	return strings.HasPrefix(s, unixPrefix) || strings.HasPrefix(s, vsockPrefix)
+}
+
+// parseVsock parses cid:port; cid may also be any, local or host
+func parseVsock(s string) (cid, port uint32, err error) {
+	c, p, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("vsock address %q: want cid:port", s)
+	}
+	switch c {
+	case "any":
+		cid = vsockCIDAny
+	case "local":
+		cid = vsockCIDLocal
+	case "host":
+		cid = vsockCIDHost
+	default:
+		n, err := strconv.ParseUint(c, 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("vsock address %q: bad cid", s)
+		}
+		cid = uint32(n)
+	}
+	n, err := strconv.ParseUint(p, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("vsock address %q: bad port", s)
+	}
+	return cid, uint32(n), nil
+}
+
+// listen opens the server listener for -p (with -i for TCP) and returns
+// the address to log
+func listen(bindIp, port string) (net.Listener, string, error) {
+	switch {
+	case strings.HasPrefix(port, unixPrefix):
+		return listenUnix(strings.TrimPrefix(port, unixPrefix))
+	case strings.HasPrefix(port, vsockPrefix):
+		cid, p, err := parseVsock(strings.TrimPrefix(port, vsockPrefix))
+		if err != nil {
+			return nil, "", err
+		}
+		l, err := listenVsock(cid, p)
+		return l, port, err
+	}
+
+	// The wildcard listens on IPv4 and IPv6 both (dual-stack)
+	bindTo := net.JoinHostPort("", port)
+	if ip := strings.Trim(bindIp, "[]"); ip != "0.0.0.0" && ip != "" {
+		bindTo = net.JoinHostPort(ip, port)
+	}
+	l, err := net.Listen("tcp", bindTo)
+	return l, bindTo, err
+}
+
+func listenUnix(path string) (net.Listener, string, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, "", err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, "", err
+	}
+	if socketPerm != 0 {
+		if err := os.Chmod(path, socketPerm); err != nil {
+			l.Close()
+			return nil, "", err
+		}
+	}
+	return l, unixPrefix + path, nil
+}
+
+// removeStaleSocket removes a socket left behind by a process that died,
+// unless something still answers on it; anything but a socket is left alone
+func removeStaleSocket(path string) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	return nil
+}
+
+// dialLocal returns the dialer for a unix: or vsock: client address
+func dialLocal(address string) (func() (net.Conn, error), error) {
+	if strings.HasPrefix(address, unixPrefix) {
+		path := strings.TrimPrefix(address, unixPrefix)
+		return func() (net.Conn, error) { return net.DialTimeout("unix", path, dialTimeout) }, nil
+	}
+	cid, port, err := parseVsock(strings.TrimPrefix(address, vsockPrefix))
+	if err != nil {
+		return nil, err
+	}
+	return func() (net.Conn, error) { return dialVsock(cid, port, dialTimeout) }, nil
+}
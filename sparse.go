@@ -0,0 +1,35 @@
+package main
+
+import "sort"
+
+// dataMap lists the allocated extents of a sparse regular file, so blocks
+// lying entirely in a hole can be treated as zero without reading them.
+// A nil *dataMap means "unknown": every block must be read.
+type dataMap struct {
+	extents [][2]int64 // sorted [start, end) byte ranges holding data
+	size    int64
+}
+
+// isHole reports whether [off, off+length) within the file has no data.
+// Ranges at or beyond EOF are not holes (callers handle EOF themselves).
+func (m *dataMap) isHole(off, length int64) bool {
+	if m == nil || off >= m.size {
+		return false
+	}
+	end := off + length
+	if end > m.size {
+		end = m.size
+	}
+	// first extent ending after off
+	i := sort.Search(len(m.extents), func(i int) bool { return m.extents[i][1] > off })
+	return i == len(m.extents) || m.extents[i][0] >= end
+}
+
+// allocated returns the number of bytes covered by data extents
+func (m *dataMap) allocated() int64 {
+	var n int64
+	for _, e := range m.extents {
+		n += e[1] - e[0]
+	}
+	return n
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// loadDataMap queries the data/hole layout of a regular file with
+// lseek(SEEK_DATA/SEEK_HOLE). Returns nil for block devices, empty files
+// and filesystems without hole reporting.
+func loadDataMap(file *os.File) *dataMap {
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil
+	}
+	defer file.Seek(0, io.SeekStart)
+
+	m := &dataMap{size: info.Size()}
+	fd := int(file.Fd())
+	var off int64
+	for off < m.size {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break // no more data: rest of the file is a hole
+		}
+		if err != nil {
+			Debug("sparse map unavailable: %s\n", err)
+			return nil
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			Debug("sparse map unavailable: %s\n", err)
+			return nil
+		}
+		m.extents = append(m.extents, [2]int64{data, hole})
+		off = hole
+	}
+
+	Log("sparse map: %d data extents, %d of %d bytes allocated\n", len(m.extents), m.allocated(), m.size)
+	return m
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// loadDataMap is only implemented on Linux; elsewhere every block is read
+func loadDataMap(file *os.File) *dataMap {
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -42,6 +43,21 @@ func parseSSHTarget(input string) (user, host, port, file string) {
 		input = parts[1]
 	}
 
+	// IPv6 literal in brackets: [2001:db8::1]:/path or [2001:db8::1]:port:/path
+	if strings.HasPrefix(input, "[") {
+		end := strings.Index(input, "]:")
+		if end < 0 {
+			Err("invalid format: %s\n", input)
+			return
+		}
+		host = input[1:end]
+		file = input[end+2:]
+		if p, rest, ok := strings.Cut(file, ":"); ok && isPortNumber(p) {
+			port, file = p, rest
+		}
+		return user, host, port, file
+	}
+
 	// Split by ':' - could be host:port:/path or host:/path or host:port:path (for Windows)
 	parts = strings.SplitN(input, ":", 3)
 	if len(parts) < 2 {
@@ -63,6 +79,72 @@ func parseSSHTarget(input string) (user, host, port, file string) {
 	return user, host, port, file
 }
 
+// passthroughArgs returns flags that must be given to the spawned server too
+func passthroughArgs() []string {
+	args := []string{"-session", logSession}
+	if logLevelCur != levelInfo {
+		args = append(args, "-log-level", strings.ToLower(levelNames[logLevelCur]))
+	}
+	if logJSON {
+		args = append(args, "-log-format", "json")
+	}
+	if dryRun {
+		args = append(args, "-dry-run")
+	}
+	if activeCodec != codecZstd && activeCodec != codecNone { // none goes as -n
+		args = append(args, "-codec", codecName(activeCodec))
+	}
+	if !entropyCheck {
+		args = append(args, "-entropy=false")
+	}
+	if name := compLevelName(); name != "default" {
+		args = append(args, "-L", name)
+	}
+	if zeroMode != "auto" {
+		args = append(args, "-zero", zeroMode)
+	}
+	if force {
+		args = append(args, "-force")
+	}
+	if cacheMode != "normal" {
+		args = append(args, "-cache", cacheMode)
+	}
+	if fsyncPolicy != "end" {
+		args = append(args, "-fsync", fsyncPolicy)
+	}
+	if !dedupEnabled {
+		args = append(args, "-dedup=false")
+	}
+	if atomicMode {
+		args = append(args, "-atomic")
+	}
+	if verifyBlocks {
+		args = append(args, "-verify")
+	}
+	if sizePolicy != "match" {
+		args = append(args, "-size", sizePolicy)
+	}
+	if progressJSON() {
+		args = append(args, "-P") // keep server text progress out of the JSON stream
+	}
+	if bwLimit != "" {
+		args = append(args, "-bwlimit", bwLimit)
+	}
+	if bwSchedule != "" {
+		args = append(args, "-bwschedule", bwSchedule)
+	}
+	if maxMemory != "" {
+		args = append(args, "-max-memory", maxMemory)
+	}
+	if ioLimit != "" {
+		args = append(args, "-iolimit", ioLimit)
+	}
+	if ioSchedule != "" {
+		args = append(args, "-ioschedule", ioSchedule)
+	}
+	return args
+}
+
 func waitForReady(stdout io.ReadCloser, isLocal bool) error {
 	Log("waiting for server..\n")
 	scanner := bufio.NewScanner(stdout)
@@ -75,10 +157,13 @@ func waitForReady(stdout io.ReadCloser, isLocal bool) error {
 				serverType = "local"
 			}
 			Log("%s server is ready\n", serverType)
-			break
+			return nil
 		}
 	}
-	return scanner.Err()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("server exited before it was ready")
 }
 
 func copyBinaryToRemote(sshTarget, sshPort string) (string, error) {
@@ -162,6 +247,7 @@ func startRemoteSSH(targetPath, port string, blockSize, skipIdx uint32, quiet bo
 		if IsEncryptionEnabled() {
 			args = append(args, "-K", GetEncryptionKeyHex())
 		}
+		args = append(args, passthroughArgs()...)
 		cmd := exec.Command(args[0], args[1:]...)
 
 		// Set up stdout pipe to capture READY signal
@@ -224,6 +310,7 @@ func startRemoteSSH(targetPath, port string, blockSize, skipIdx uint32, quiet bo
 	if IsEncryptionEnabled() {
 		args = append(args, "-K", GetEncryptionKeyHex())
 	}
+	args = append(args, passthroughArgs()...)
 
 	Log("spawning ssh with args: %s\n", args)
 	cmd := exec.Command(args[0], args[1:]...)
@@ -276,6 +363,7 @@ func startRemoteSSHDownload(targetPath, port string, blockSize, skipIdx uint32,
 		if IsEncryptionEnabled() {
 			args = append(args, "-K", GetEncryptionKeyHex())
 		}
+		args = append(args, passthroughArgs()...)
 		cmd := exec.Command(args[0], args[1:]...)
 
 		// Set up stdout pipe to capture READY signal
@@ -338,6 +426,7 @@ func startRemoteSSHDownload(targetPath, port string, blockSize, skipIdx uint32,
 	if IsEncryptionEnabled() {
 		args = append(args, "-K", GetEncryptionKeyHex())
 	}
+	args = append(args, passthroughArgs()...)
 
 	Log("spawning ssh for download with args: %s\n", args)
 	cmd := exec.Command(args[0], args[1:]...)
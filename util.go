@@ -1,27 +1,94 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	"sync"
 	"unsafe"
 )
 
-// Shared zero buffer for writing zero blocks (100MB max to handle typical block sizes)
+// Destination size policy (-size) when source and destination sizes differ:
+// match - resize regular files to the source size
+// keep  - grow regular files, never shrink them
+// fail  - never resize, refuse a destination smaller than the source
+// Devices are never resized: a smaller device is always refused, a larger one
+// keeps its trailing data.
+var sizePolicy = "match"
+
+func setSizePolicy(policy string) {
+	switch policy {
+	case "match", "keep", "fail":
+		sizePolicy = policy
+	default:
+		Err("unknown size policy: %s (use match, keep, fail)\n", policy)
+	}
+}
+
+// Shared zero buffer for writing zero blocks, taken from the buffer pool at
+// the size of the largest block zeroed so far
 var (
 	zeroBuf    []byte
 	zeroBufMu  sync.Mutex
-	zeroBufMax = 100 * 1024 * 1024 // 100MB - covers most block sizes
+	zeroBufMax = 100 * 1024 * 1024 // longer ranges are written in chunks of this
 )
 
 func getZeroBuf(size int) []byte {
-	if size <= zeroBufMax {
-		zeroBufMu.Lock()
-		defer zeroBufMu.Unlock()
-		if zeroBuf == nil {
-			zeroBuf = make([]byte, zeroBufMax)
+	zeroBufMu.Lock()
+	defer zeroBufMu.Unlock()
+	if cap(zeroBuf) < size {
+		if size < int(blockSize) {
+			size = int(blockSize)
+		}
+		// The old buffer may still be in use by another writer: never reuse it
+		bufPool.Discard(zeroBuf)
+		zeroBuf = bufPool.GetInFlight(size)
+		clear(zeroBuf)
+	}
+	return zeroBuf[:size]
+}
+
+// blockLen returns the length of block idx, shorter for the file's tail
+func blockLen(idx uint32, blockSize uint32, fileSize uint64) uint64 {
+	offset := uint64(idx) * uint64(blockSize)
+	if offset >= fileSize {
+		return 0
+	}
+	if fileSize-offset < uint64(blockSize) {
+		return fileSize - offset
+	}
+	return uint64(blockSize)
+}
+
+// applySizePolicy validates the destination against the source size and
+// resizes a regular file as -size allows. With checkOnly nothing is resized.
+// Must run before the first block is written.
+func applySizePolicy(file *os.File, srcSize uint64, checkOnly bool) error {
+	var dstSize uint64
+	regular := isRegularDestination(file)
+	if regular {
+		info, err := file.Stat()
+		if err != nil {
+			return err
 		}
-		return zeroBuf[:size]
+		dstSize = uint64(info.Size())
+	} else {
+		dstSize = getDeviceSize(file)
+	}
+
+	switch {
+	case dstSize == srcSize:
+		return nil
+	case dstSize < srcSize && (!regular || sizePolicy == "fail"):
+		return fmt.Errorf("destination is smaller than source: %d < %d bytes", dstSize, srcSize)
+	case dstSize > srcSize && (!regular || sizePolicy != "match"):
+		Warn("destination is larger than source (%d > %d bytes), trailing data left untouched\n", dstSize, srcSize)
+		return nil
+	}
+
+	if !checkOnly {
+		truncateIfRegularFile(file, srcSize)
 	}
-	return make([]byte, size)
+	return nil
 }
 
 // isZeroBlock checks if all bytes are zero using optimized 8-byte comparison
@@ -20,7 +20,7 @@ func getDeviceSize(file *os.File) uint64 {
 func truncateIfRegularFile(file *os.File, size uint64) {
 	info, err := file.Stat()
 	if err != nil {
-		Log("Error: file stat failed: %v\n", err)
+		Error("Error: file stat failed: %v\n", err)
 	}
 
 	mode := info.Mode()
@@ -36,3 +36,12 @@ func truncateIfRegularFile(file *os.File, size uint64) {
 		}
 	}
 }
+
+// isRegularDestination reports whether file can be resized (not a device)
+func isRegularDestination(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode().IsRegular()
+}
@@ -58,7 +58,7 @@ func getDeviceSize(file *os.File) uint64 {
 		return size
 	}
 
-	Log("Error: cannot determine size of %s: %v\n", file.Name(), err)
+	Error("Error: cannot determine size of %s: %v\n", file.Name(), err)
 	return 0
 }
 
@@ -74,7 +74,7 @@ func truncateIfRegularFile(file *os.File, size uint64) {
 
 	info, err := file.Stat()
 	if err != nil {
-		Log("Error: file stat failed: %v\n", err)
+		Error("Error: file stat failed: %v\n", err)
 		return
 	}
 
@@ -88,3 +88,15 @@ func truncateIfRegularFile(file *os.File, size uint64) {
 		}
 	}
 }
+
+// isRegularDestination reports whether file can be resized (not a device)
+func isRegularDestination(file *os.File) bool {
+	if isWindowsDevicePath(file.Name()) {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode().IsRegular()
+}
@@ -0,0 +1,150 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The standard library has no AF_VSOCK support: sockets are opened
+// non-blocking and wrapped in an os.File, which puts them on the runtime
+// poller, so reads, writes and deadlines behave as on a TCP connection.
+
+type vsockAddr struct {
+	cid, port uint32
+}
+
+func (a vsockAddr) Network() string { return "vsock" }
+func (a vsockAddr) String() string  { return fmt.Sprintf("vsock:%d:%d", a.cid, a.port) }
+
+type vsockConn struct {
+	*os.File
+	local, remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+type vsockListener struct {
+	f    *os.File
+	addr vsockAddr
+}
+
+func vsockSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	return fd, nil
+}
+
+func listenVsock(cid, port uint32) (net.Listener, error) {
+	fd, err := vsockSocket()
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return &vsockListener{f: os.NewFile(uintptr(fd), "vsock"), addr: vsockAddr{cid, port}}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	rc, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var nfd int
+	var sa unix.Sockaddr
+	var aerr error
+	err = rc.Read(func(fd uintptr) bool {
+		nfd, sa, aerr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return aerr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if aerr != nil {
+		return nil, os.NewSyscallError("accept4", aerr)
+	}
+	return newVsockConn(nfd, sa), nil
+}
+
+func (l *vsockListener) Close() error   { return l.f.Close() }
+func (l *vsockListener) Addr() net.Addr { return l.addr }
+
+func newVsockConn(fd int, remote unix.Sockaddr) *vsockConn {
+	c := &vsockConn{File: os.NewFile(uintptr(fd), "vsock")}
+	if vm, ok := remote.(*unix.SockaddrVM); ok {
+		c.remote = vsockAddr{vm.CID, vm.Port}
+	}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			c.local = vsockAddr{vm.CID, vm.Port}
+		}
+	}
+	return c
+}
+
+// dialVsock connects to cid:port, giving up after timeout
+func dialVsock(cid, port uint32, timeout time.Duration) (net.Conn, error) {
+	fd, err := vsockSocket()
+	if err != nil {
+		return nil, err
+	}
+	sa := &unix.SockaddrVM{CID: cid, Port: port}
+	err = unix.Connect(fd, sa)
+	if err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+	c := newVsockConn(fd, sa)
+	if err == nil {
+		return c, nil
+	}
+
+	// Wait until the socket is writable, then read the connect result
+	c.SetWriteDeadline(time.Now().Add(timeout))
+	rc, err := c.SyscallConn()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	var cerr error
+	err = rc.Write(func(fd uintptr) bool {
+		n, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		switch {
+		case err != nil:
+			cerr = err
+		case n == int(unix.EINPROGRESS) || n == int(unix.EALREADY):
+			return false
+		case n != 0:
+			cerr = unix.Errno(n)
+		default:
+			// No error yet: connected once the peer is known
+			if _, err := unix.Getpeername(int(fd)); err == unix.ENOTCONN {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.Close()
+		return nil, os.NewSyscallError("connect", err)
+	}
+	c.SetWriteDeadline(time.Time{})
+	return c, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+func listenVsock(cid, port uint32) (net.Listener, error) {
+	return nil, errVsockUnsupported
+}
+
+func dialVsock(cid, port uint32, timeout time.Duration) (net.Conn, error) {
+	return nil, errVsockUnsupported
+}
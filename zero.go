@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// How zero blocks that overwrite non-zero destination data are applied
+// (-zero flag):
+//
+//	auto     punch holes in regular files, write zeros to block devices
+//	write    always write zero buffers
+//	punch    fallocate(PUNCH_HOLE|KEEP_SIZE) on files and block devices;
+//	         a device that cannot punch holes fails the block
+//	discard  punch on block devices too, BLKZEROOUT where they cannot;
+//	         discarded ranges always read back as zeros
+//	zeroout  BLKZEROOUT on block devices, punch on files
+var zeroMode = "auto"
+
+var (
+	errZeroUnsupported = errors.New("zeroing method not supported")
+	errNoPunch         = errors.New("-zero punch: the block device cannot punch holes (use -zero discard or zeroout)")
+)
+
+// setZeroMode validates and sets the -zero flag value
+func setZeroMode(mode string) {
+	switch mode {
+	case "auto", "write", "punch", "discard", "zeroout":
+	default:
+		Err("unknown zero mode: %s (use auto, write, punch, discard, zeroout)\n", mode)
+	}
+	zeroMode = mode
+}
+
+// zeroRange makes [offset, offset+length) of file read as zeros, using the
+// configured method and falling back to writing zero buffers, except for
+// -zero punch on a device that cannot punch holes
+func zeroRange(file *os.File, offset, length int64) error {
+	if zeroMode != "write" {
+		err := zeroRangeNative(file, offset, length)
+		if err == nil || errors.Is(err, errNoPunch) {
+			return err
+		}
+		if err != errZeroUnsupported {
+			Debug("zero range at %d: %s, writing zeros instead\n", offset, err)
+		}
+	}
+	return writeZeros(file, offset, length)
+}
+
+// writeZeros writes zero buffers over the range, in chunks of the shared buffer
+func writeZeros(file *os.File, offset, length int64) error {
+	for length > 0 {
+		n := length
+		if n > int64(zeroBufMax) {
+			n = int64(zeroBufMax)
+		}
+		if _, err := writeAt(file, getZeroBuf(int(n)), offset); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// zeroRangeNative punches a hole in regular files; on block devices
+// -zero punch and discard punch the range too (the kernel unmaps it only
+// where the device reads it back as zeros, and zeroes it otherwise),
+// discard falling back to BLKZEROOUT, and zeroout issues BLKZEROOUT
+func zeroRangeNative(file *os.File, offset, length int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	fd := int(file.Fd())
+
+	if info.Mode().IsRegular() {
+		return punchHole(fd, offset, length)
+	}
+
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return errZeroUnsupported
+	}
+
+	switch zeroMode {
+	case "punch":
+		if err := punchHole(fd, offset, length); err != nil {
+			return fmt.Errorf("%w: %v", errNoPunch, err)
+		}
+		return nil
+	case "discard":
+		err := punchHole(fd, offset, length)
+		if err != unix.EOPNOTSUPP {
+			return err
+		}
+		Debug("zero range at %d: device cannot punch holes, BLKZEROOUT instead\n", offset)
+		return blkZeroout(fd, offset, length)
+	case "zeroout":
+		return blkZeroout(fd, offset, length)
+	}
+	return errZeroUnsupported
+}
+
+func punchHole(fd int, offset, length int64) error {
+	return unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+}
+
+func blkZeroout(fd int, offset, length int64) error {
+	rng := [2]uint64{uint64(offset), uint64(length)}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.BLKZEROOUT, uintptr(unsafe.Pointer(&rng))); errno != 0 {
+		return errno
+	}
+	return nil
+}
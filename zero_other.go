@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// zeroRangeNative is only implemented on Linux; elsewhere zeros are written
+func zeroRangeNative(file *os.File, offset, length int64) error {
+	return errZeroUnsupported
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestZeroRangePunch(t *testing.T) {
+	defer func() { zeroMode = "auto" }()
+
+	const size, off, length = 1 << 20, 256 << 10, 512 << 10
+	f, err := os.CreateTemp(t.TempDir(), "zero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(bytes.Repeat([]byte{0xAB}, size)); err != nil {
+		t.Fatal(err)
+	}
+	f.Sync()
+	var before syscall.Stat_t
+	syscall.Fstat(int(f.Fd()), &before)
+
+	for _, mode := range []string{"punch", "discard", "zeroout"} {
+		zeroMode = mode
+		if err := zeroRange(f, off, length); err != nil {
+			t.Fatalf("%s: zeroRange() error: %v", mode, err)
+		}
+		f.Sync()
+
+		buf := make([]byte, size)
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !isZeroBlock(buf[off : off+length]) {
+			t.Errorf("%s: range does not read back as zeros", mode)
+		}
+		if buf[off-1] != 0xAB || buf[off+length] != 0xAB {
+			t.Errorf("%s: data around the range changed", mode)
+		}
+
+		var after syscall.Stat_t
+		syscall.Fstat(int(f.Fd()), &after)
+		if after.Size != size {
+			t.Errorf("%s: size changed to %d", mode, after.Size)
+		}
+		if after.Blocks >= before.Blocks {
+			t.Errorf("%s: %d blocks allocated, %d before: no hole punched", mode, after.Blocks, before.Blocks)
+		}
+	}
+}